@@ -1,8 +1,13 @@
 package myrpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -28,7 +33,8 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, err := newService(&foo)
+	_assert(err == nil, "failed to create service: %v", err)
 	fmt.Println(len(s.method))
 	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
 	metType := s.method["Sum"]
@@ -38,15 +44,106 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo)
 	metType := s.method["Sum"]
 
 	argv := metType.newArgv()
 	replyv := metType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
-	err := s.call(metType, argv, replyv)
+	err := s.call(metType, context.Background(), argv, replyv)
 	fmt.Println(err)
 	fmt.Println(metType.numCalls)
 	fmt.Println(*replyv.Interface().(*int))
 	_assert(err == nil && *replyv.Interface().(*int) == 3 && metType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+type Ctx int
+
+type ctxKey struct{}
+
+func (c Ctx) Sum(ctx context.Context, args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2 + ctx.Value(ctxKey{}).(int)
+	return nil
+}
+
+func TestMethodType_CallWithContext(t *testing.T) {
+	var c Ctx
+	s, _ := newService(&c)
+	metType := s.method["Sum"]
+	_assert(metType != nil && metType.ArgType == reflect.TypeOf(Args{}), "expect Sum with a context.Context to be registered")
+
+	argv := metType.newArgv()
+	replyv := metType.newReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
+	err := s.call(metType, context.WithValue(context.Background(), ctxKey{}, 10), argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 13, "expect ctx to be passed to Ctx.Sum")
+}
+
+type unexported int
+
+func (u unexported) Sum(args Args, reply *int) error {
+	return nil
+}
+
+func TestServer_RegisterInvalid(t *testing.T) {
+	server := NewServer()
+	var u unexported
+	err := server.Register(&u)
+	_assert(err != nil && strings.Contains(err.Error(), "not a valid service name"), "expect an error for unexported receiver, got %v", err)
+	var foo Foo
+	_assert(server.Register(&foo) == nil, "failed to register Foo")
+	_assert(server.Register(&foo) != nil, "expect an error for duplicated service")
+}
+
+func TestServer_RegisterHealth(t *testing.T) {
+	server := NewServer()
+	_, _, err := server.findService(HealthServiceMethod)
+	_assert(err != nil, "expect Health not registered by default")
+	_assert(server.RegisterHealth() == nil, "failed to register Health")
+	_, _, err = server.findService(HealthServiceMethod)
+	_assert(err == nil, "expect Health registered, got %v", err)
+	_assert(server.RegisterHealth() != nil, "expect an error for duplicated Health")
+}
+
+func TestServer_UnknownService(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	// 调用不存在的服务返回服务端错误，连接仍然可以使用
+	var reply int
+	err = client.Call(context.Background(), "Missing.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	var serverErr ServerError
+	_assert(errors.As(err, &serverErr) && strings.Contains(err.Error(), "can`t find service"), "expect a server error, got %v", err)
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect the connection to be reused, got %v", err)
+}
+
+func TestServer_ZeroValue(t *testing.T) {
+	server := new(Server)
+	_ = server.Register(new(Foo))
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect a zero Server to serve requests, got %v", err)
+	_assert(server.serverMetrics().lookup("Foo.Sum") != nil, "expect the request to be counted")
+}
+
+func TestStdLogger(t *testing.T) {
+	var b strings.Builder
+	var h LoggerHolder
+	h.Store(NewStdLogger(log.New(&b, "", 0), LevelWarn))
+	h.Infof("info %d", 1)
+	h.Warnf("warn %d", 2)
+	h.Errorf("error %d", 3)
+	_assert(b.String() == "warn 2\nerror 3\n", "unexpected output %q", b.String())
+	h.Store(nil)
+	_assert(h.Load() == DefaultLogger, "expect nil to reset to DefaultLogger")
+}
@@ -0,0 +1,230 @@
+package myrpc
+
+import (
+	"MyRpc/07_registry/myrpc/codec"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessEntry 是访问日志中的一条记录，对应一次调用
+type AccessEntry struct {
+	Time          time.Time     `json:"time"`
+	Side          SpanKind      `json:"side"` // 由服务端还是客户端记录
+	Peer          string        `json:"peer,omitempty"`
+	ServiceMethod string        `json:"service_method"`
+	Seq           uint64        `json:"seq"`
+	Latency       time.Duration `json:"latency"` // JSON 中单位为纳秒
+	Code          string        `json:"code"`    // 成功时为 ok，失败时见 ErrorCode
+	Error         string        `json:"error,omitempty"`
+	RequestSize   int64         `json:"request_size"`  // 请求的字节数，包括请求头
+	ResponseSize  int64         `json:"response_size"` // 响应的字节数，包括响应头
+	TraceID       string        `json:"trace_id,omitempty"`
+}
+
+// CodeOK 是访问日志中成功的调用的状态
+const CodeOK = "ok"
+
+// AccessSink 写入访问日志，需要能被并发调用
+type AccessSink interface {
+	Write(entry *AccessEntry) error
+}
+
+// AccessLog 按采样率把调用记录到 AccessSink，可以在运行时打开或关闭
+type AccessLog struct {
+	sink     AccessSink
+	disabled int32  // 为1时不记录
+	rate     uint64 // 采样率，float64 的位表示
+}
+
+// NewAccessLog 返回写入 sink 的访问日志，默认打开并记录所有调用
+func NewAccessLog(sink AccessSink) *AccessLog {
+	return &AccessLog{sink: sink, rate: math.Float64bits(1)}
+}
+
+// SetEnabled 打开或关闭访问日志
+func (l *AccessLog) SetEnabled(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&l.disabled, v)
+}
+
+// Enabled 返回访问日志是否打开
+func (l *AccessLog) Enabled() bool {
+	return atomic.LoadInt32(&l.disabled) == 0
+}
+
+// SetSampleRate 设置成功的调用被记录的比例，取值 [0, 1]。失败的调用总是被记录
+func (l *AccessLog) SetSampleRate(rate float64) {
+	atomic.StoreUint64(&l.rate, math.Float64bits(rate))
+}
+
+// sampled 判断一次调用是否需要记录
+func (l *AccessLog) sampled(code string) bool {
+	if l == nil || !l.Enabled() {
+		return false
+	}
+	if code != CodeOK {
+		return true
+	}
+	rate := math.Float64frombits(atomic.LoadUint64(&l.rate))
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// write 写入一条记录，失败时输出到 logger
+func (l *AccessLog) write(logger *LoggerHolder, entry *AccessEntry) {
+	if err := l.sink.Write(entry); err != nil {
+		logger.Errorf("rpc: write access log error: %v", err)
+	}
+}
+
+// accessLogHolder 用于在 atomic.Value 中保存可能为 nil 的 *AccessLog
+type accessLogHolder struct {
+	log *AccessLog
+}
+
+func loadAccessLog(v *atomic.Value) *AccessLog {
+	h, _ := v.Load().(accessLogHolder)
+	return h.log
+}
+
+// SetAccessLog 设置服务端的访问日志，为 nil 时不记录
+func (server *Server) SetAccessLog(l *AccessLog) {
+	server.accessLog.Store(accessLogHolder{log: l})
+}
+
+// SetAccessLog 设置客户端的访问日志，只记录通过 Call 发起的调用，为 nil 时不记录
+func (client *Client) SetAccessLog(l *AccessLog) {
+	client.accessLog.Store(accessLogHolder{log: l})
+}
+
+// accessCode 返回访问日志中的状态，code 为指标中的错误码
+func accessCode(code string) string {
+	if code == "" {
+		return CodeOK
+	}
+	return code
+}
+
+// bytesCounted 返回 cc 累计读写的字节数，cc 不支持统计时返回 0
+func bytesCounted(cc codec.Codec) (read, written int64) {
+	if c, ok := cc.(codec.ByteCounter); ok {
+		return c.BytesRead(), c.BytesWritten()
+	}
+	return 0, 0
+}
+
+// JSONSink 把访问日志以 JSON lines 的格式写入 w
+type JSONSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var _ AccessSink = (*JSONSink)(nil)
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{enc: json.NewEncoder(w)}
+}
+
+func (s *JSONSink) Write(entry *AccessEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(entry)
+}
+
+// RotatingFile 是按大小轮转的文件，超过 MaxSize 时把 path 重命名为 path.1，
+// 原来的 path.1 重命名为 path.2，依次类推，最多保留 maxBackups 个旧文件
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+var _ io.WriteCloser = (*RotatingFile)(nil)
+
+// NewRotatingFile 打开 path 用于追加，maxSize 为每个文件的最大字节数
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write 写入 p，写入后会超过 maxSize 时先轮转。一次写入不会被拆到两个文件中
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate 关闭当前文件，依次重命名旧文件，再打开新的文件。
+// 重命名失败时继续写入原来的文件。调用时需要持有f.mu
+func (f *RotatingFile) rotate() error {
+	_ = f.file.Close()
+	err := f.renameBackups()
+	if openErr := f.open(); openErr != nil {
+		f.file = nil
+		return openErr
+	}
+	return err
+}
+
+func (f *RotatingFile) renameBackups() error {
+	if f.maxBackups <= 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,23 @@
+package myrpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff 计算第 n 次失败后的等待时间：base * 2^(n-1)，不超过 limit，再加上随机抖动。
+// 用于心跳、建立连接和调用的重试
+func Backoff(base, limit time.Duration, n int) time.Duration {
+	d := limit
+	if n < 32 {
+		if exp := base << uint(n-1); exp > 0 && exp < limit {
+			d = exp
+		}
+	}
+	// 在 [d/2, d) 之间取随机值，避免所有客户端同时重试
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
@@ -8,11 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,7 +23,10 @@ type Call struct {
 	Args          interface{} // arguments to the function
 	Reply         interface{} // reply from the function
 	Error         error       // if error occurs, it will be set
+	Metadata      map[string]string // 随请求发送的元数据
 	Done          chan *Call  // Strobes when call is complete.
+	requestSize   int64       // 请求的字节数，由发送请求的协程写入
+	responseSize  int64       // 响应的字节数，在Done之前写入
 }
 
 func (call *Call) done() {
@@ -40,12 +43,22 @@ type Client struct {
 	pending  map[uint64]*Call
 	closing  bool
 	shutdown bool		//服务器宕机
+	peer     string		// 服务端地址，用于访问日志
+	accessLog atomic.Value // 访问日志，见 SetAccessLog
+	logger   LoggerHolder	// 日志，默认为 Option.Logger，见 SetLogger
 }
 
 var _ io.Closer = (*Client)(nil)
 
 var ErrShutdown = errors.New("connection is shut down")
 
+// ServerError 是服务端处理请求时返回的错误，说明请求已经到达了服务端
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
 // 关闭客户端
 func (client *Client) Close() error {
 	client.mu.Lock()
@@ -105,6 +118,7 @@ func (client *Client) receive() {
 	var err error
 	for err == nil {
 		var header codec.Header
+		before, _ := bytesCounted(client.cc)
 		if err = client.cc.ReadHeader(&header); err != nil {
 			break
 		}
@@ -115,8 +129,9 @@ func (client *Client) receive() {
 			err = client.cc.ReadBody(nil)
 		//call存在，但服务器报错
 		case header.Error != "":
-			call.Error = fmt.Errorf(header.Error)
+			call.Error = ServerError(header.Error)
 			err = client.cc.ReadBody(nil)
+			call.responseSize = client.bytesReadSince(before)
 			call.done()
 		//call存在，服务器处理正常
 		default:
@@ -124,6 +139,7 @@ func (client *Client) receive() {
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
 			}
+			call.responseSize = client.bytesReadSince(before)
 			call.done()
 		}
 	}
@@ -133,29 +149,46 @@ func (client *Client) receive() {
 
 // 得到client客户端
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
+	client := newClient(opt)
 	newCodec := codec.NewCodecFuncMap[opt.CodecType]
 	if newCodec == nil {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
-		log.Println("rpc client: codec error:", err)
+		client.logger.Errorf("rpc client: codec error: %v", err)
 		return nil, err
 	}
+	// 统计读写的字节数和打开的连接数
+	conn = clientMetrics.countConn(conn)
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client: options error: ", err)
+		client.logger.Errorf("rpc client: options error: %v", err)
+		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(newCodec(conn), opt), nil
+	client.cc = newCodec(conn)
+	client.peer = conn.RemoteAddr().String()
+	// 开始从服务器接收数据
+	go client.receive()
+	return client, nil
+}
+
+// SetLogger 设置客户端的日志，为 nil 时使用 DefaultLogger
+func (client *Client) SetLogger(l Logger) {
+	client.logger.Store(l)
+}
+
+// bytesReadSince 返回 before 之后从连接读取的字节数
+func (client *Client) bytesReadSince(before int64) int64 {
+	after, _ := bytesCounted(client.cc)
+	return after - before
 }
 
-// 返回client客户端
-func newClientCodec(cc codec.Codec, opt *Option) *Client {
+// 返回还没有连接的client客户端，日志为 opt.Logger
+func newClient(opt *Option) *Client {
 	client := &Client{
 		seq: 1,
-		cc: cc,
 		opt: opt,
 		pending: make(map[uint64]*Call),
 	}
-	// 开始从服务器接收数据
-	go client.receive()
+	client.logger.Store(opt.Logger)
 	return client
 }
 
@@ -171,8 +204,13 @@ func (client *Client) send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Metadata = call.Metadata
 
-	if err = client.cc.Write(&client.header, call.Args); err != nil {
+	_, before := bytesCounted(client.cc)
+	err = client.cc.Write(&client.header, call.Args)
+	_, after := bytesCounted(client.cc)
+	call.requestSize = after - before
+	if err != nil {
 		call = client.removeCall(seq)
 		if call != nil {
 			call.Error = err
@@ -222,7 +260,7 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
-		log.Panic("rpc client: done channel is unbuffered")
+		panic("rpc client: done channel is unbuffered")
 	}
 	call := &Call{
 		ServiceMethod: serviceMethod,
@@ -237,17 +275,88 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 // Call invokes the named function, wait for it to complete
 // and return its error status
 // 新增超时处理
-func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+// ctx 中通过 WithMetadata 设置的元数据会随请求发送，
+// 每次调用是 ctx 中 span 的子 span，通过元数据中的 traceparent 传给服务端
+func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	if withoutTelemetry(ctx) {
+		return client.wait(ctx, &Call{
+			ServiceMethod: serviceMethod,
+			Args: args,
+			Reply: reply,
+			Metadata: Metadata(ctx),
+			Done: make(chan *Call, 1),
+		})
+	}
+	mm := clientMetrics.method(serviceMethod)
+	mm.begin()
+	start := time.Now()
+	span, md := clientSpan(ctx, serviceMethod)
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+		Metadata: md,
+		Done: make(chan *Call, 1),
+	}
+	defer func() {
+		mm.end(time.Since(start), ErrorCode(err))
+		span.finish(err)
+		client.logAccess(call, start, err, span.span.TraceID)
+	}()
+	return client.wait(ctx, call)
+}
+
+// wait 发送 call 并等待响应，ctx 结束时不再等待
+func (client *Client) wait(ctx context.Context, call *Call) error {
+	client.send(call)
 	select {
 	case <-ctx.Done():
 		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
-	case call = <- call.Done:
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+	case <- call.Done:
 		return call.Error
 	}
 }
 
+type noTelemetryKey struct{}
+
+// WithoutTelemetry 返回的 ctx 发起的 Call 不计入客户端指标和访问日志，也不开始新的 span，
+// 用于健康检查、长轮询等不属于业务流量的内部调用。元数据仍然随请求发送
+func WithoutTelemetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTelemetryKey{}, true)
+}
+
+func withoutTelemetry(ctx context.Context) bool {
+	v, _ := ctx.Value(noTelemetryKey{}).(bool)
+	return v
+}
+
+// logAccess 在访问日志中记录一次调用。超时或取消时 call 可能还没有收到响应，响应大小为0
+func (client *Client) logAccess(call *Call, start time.Time, err error, traceID string) {
+	l := loadAccessLog(&client.accessLog)
+	code := accessCode(ErrorCode(err))
+	if !l.sampled(code) {
+		return
+	}
+	entry := &AccessEntry{
+		Time:          start,
+		Side:          SpanKindClient,
+		Peer:          client.peer,
+		ServiceMethod: call.ServiceMethod,
+		Seq:           call.Seq,
+		Latency:       time.Since(start),
+		Code:          code,
+		RequestSize:   call.requestSize,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.ResponseSize = call.responseSize
+	}
+	entry.TraceID = traceID
+	l.write(&client.logger, entry)
+}
+
 type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
 
 type clientResult struct {
@@ -311,7 +420,12 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 	return dialTimeout(NewHTTPClient, network, address, opts...)
 }
 
+// XDial 根据地址中的协议建立连接，地址格式为 protocol@addr。
+// 服务发现可能在地址的 ? 之后附带元数据（如权重），建立连接时忽略
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
+	if i := strings.Index(rpcAddr, "?"); i >= 0 {
+		rpcAddr = rpcAddr[:i]
+	}
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
@@ -1,12 +1,20 @@
 package myrpc
 
 import (
+	"MyRpc/07_registry/myrpc/codec"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http/httptest"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -94,4 +102,445 @@ func TestXDial(t *testing.T) {
 		_, err := XDial("unix@" + addr)
 		_assert(err == nil, "failed to connect unix socket")
 	}
-}
\ No newline at end of file
+}
+
+type Broken int
+
+func (b Broken) Fail(argv int, reply *int) error {
+	return errors.New("broken")
+}
+
+func TestServer_Metrics(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Broken))
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	// 所有的 Client 共享客户端指标，比较调用前后的值
+	clientErrors := func() float64 {
+		var b strings.Builder
+		clientMetrics.write(NewMetricsWriter(&b), "myrpc_client")
+		return metricValue(b.String(), `myrpc_client_errors_total{method="Broken.Fail",code="server_error"}`)
+	}
+	before := clientErrors()
+	var reply int
+	_assert(client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil, "expect Foo.Sum to succeed")
+	_assert(client.Call(context.Background(), "Broken.Fail", 1, &reply) != nil, "expect Broken.Fail to fail")
+	_assert(clientErrors() == before+1, "expect the client error to be counted once, got %v -> %v", before, clientErrors())
+
+	expected := []string{
+		`myrpc_server_requests_total{method="Foo.Sum"} 1`,
+		`myrpc_server_errors_total{method="Broken.Fail",code="server_error"} 1`,
+		`myrpc_server_request_duration_seconds_bucket{method="Foo.Sum",le="+Inf"} 1`,
+		`myrpc_server_request_duration_seconds_count{method="Broken.Fail"} 1`,
+		`myrpc_server_inflight_requests{method="Foo.Sum"} 0`,
+		`myrpc_server_open_connections 1`,
+		"# TYPE myrpc_client_request_duration_seconds histogram",
+	}
+	// 服务端在发送响应的同时记录指标，等待记录完成
+	var body string
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		metricsHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultMetricsPath, nil))
+		body = w.Body.String()
+		if strings.Contains(body, `myrpc_server_requests_total{method="Broken.Fail"} 1`) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for _, line := range expected {
+		_assert(strings.Contains(body, line), "expect %q in metrics:\n%s", line, body)
+	}
+	_assert(!strings.Contains(body, "bytes_total 0\n"), "expect bytes to be counted:\n%s", body)
+}
+
+// metricValue 返回指标页面中 series 的值，没有时返回 0
+func metricValue(body, series string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsWriter(t *testing.T) {
+	var b strings.Builder
+	w := NewMetricsWriter(&b)
+	w.Family("test_total", "counter", "Test.")
+	w.Sample("test_total", 1.5, "path", "a\"b\\c\nd")
+	expected := "# HELP test_total Test.\n# TYPE test_total counter\ntest_total{path=\"a\\\"b\\\\c\\nd\"} 1.5\n"
+	_assert(w.Err() == nil && b.String() == expected, "unexpected output %q", b.String())
+}
+
+func TestSlidingHistogram(t *testing.T) {
+	h := newSlidingHistogram(time.Minute)
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		h.add(now, time.Duration(i)*time.Millisecond)
+	}
+	p50, p90, p99 := h.quantiles(now)
+	near := func(got, want time.Duration) bool {
+		return got >= want*8/10 && got <= want*12/10
+	}
+	_assert(near(p50, 50*time.Millisecond) && near(p90, 90*time.Millisecond) && near(p99, 99*time.Millisecond),
+		"unexpected quantiles %s %s %s", p50, p90, p99)
+
+	// 调用频繁时窗口仍然覆盖要求的时间，过期的时间片不再计入
+	for i := 0; i < 2000; i++ {
+		h.add(now.Add(time.Second*30), time.Millisecond)
+	}
+	_, _, p99 = h.quantiles(now.Add(time.Second * 30))
+	_assert(near(p99, 79*time.Millisecond), "expect older samples within the window to count, got %s", p99)
+	p50, _, p99 = h.quantiles(now.Add(time.Second * 75))
+	_assert(near(p50, time.Millisecond) && near(p99, time.Millisecond), "expect expired samples to be dropped, got %s %s", p50, p99)
+	p50, _, _ = h.quantiles(now.Add(time.Minute * 2))
+	_assert(p50 == 0, "expect an empty window, got %s", p50)
+}
+
+type Blocker chan struct{}
+
+func (b Blocker) Wait(argv int, reply *int) error {
+	<-b
+	return nil
+}
+
+func TestServer_Debug(t *testing.T) {
+	server := NewServer()
+	block := make(Blocker)
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Broken))
+	_ = server.Register(block)
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_assert(client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil, "expect Foo.Sum to succeed")
+	call := client.Go("Blocker.Wait", 1, new(int), nil)
+
+	get := func() debugData {
+		w := httptest.NewRecorder()
+		debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath+"?format=json", nil))
+		var data debugData
+		_assert(json.NewDecoder(w.Body).Decode(&data) == nil, "expect valid JSON")
+		return data
+	}
+	var data debugData
+	for i := 0; i < 100; i++ {
+		if data = get(); len(data.Running) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(len(data.Running) == 1 && data.Running[0].ServiceMethod == "Blocker.Wait", "unexpected running requests %+v", data.Running)
+	_assert(len(data.Conns) == 1 && data.Conns[0].Codec == DefaultOption.CodecType && data.Conns[0].Peer != "", "unexpected connections %+v", data.Conns)
+	var sum *debugMethod
+	for _, svc := range data.Services {
+		for i := range svc.Methods {
+			if svc.Name == "Foo" && svc.Methods[i].Name == "Sum" {
+				sum = &svc.Methods[i]
+			}
+		}
+	}
+	_assert(sum != nil && sum.Calls == 1 && len(sum.Latency) == len(latencyWindows), "unexpected Foo.Sum %+v", sum)
+	_assert(sum.Latency[0].P99 > 0 && sum.Latency[0].P50 <= sum.Latency[0].P99, "unexpected latency %+v", sum.Latency)
+	// 调试页面不会为没有调用过的方法增加指标
+	_assert(server.metrics.lookup("Broken.Fail") == nil, "expect the debug page not to create metrics")
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "Running requests") && strings.Contains(w.Body.String(), "Blocker.Wait"), "expect running request in HTML:\n%s", w.Body.String())
+
+	close(block)
+	<-call.Done
+	for i := 0; i < 100; i++ {
+		if data = get(); len(data.Running) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(len(data.Running) == 0, "expect no running requests after the call returned")
+}
+
+// Relay 把调用转发给另一个服务，用于验证调用链的传递
+type Relay struct {
+	client *Client
+}
+
+func (r *Relay) Sum(ctx context.Context, args Args, reply *int) error {
+	return r.client.Call(ctx, "Foo.Sum", args, reply)
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (r *spanRecorder) Export(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, *span)
+}
+
+func TestTrace(t *testing.T) {
+	backend := NewServer()
+	_ = backend.Register(new(Foo))
+	backendLis, _ := net.Listen("tcp", ":0")
+	go backend.Accept(backendLis)
+	backendClient, err := Dial("tcp", backendLis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = backendClient.Close() }()
+	frontend := NewServer()
+	_ = frontend.Register(&Relay{client: backendClient})
+	frontendLis, _ := net.Listen("tcp", ":0")
+	go frontend.Accept(frontendLis)
+	client, err := Dial("tcp", frontendLis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	recorder := new(spanRecorder)
+	SetExporter(recorder)
+	defer SetExporter(nil)
+	var reply int
+	err = client.Call(context.Background(), "Relay.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "unexpected result %d, %v", reply, err)
+
+	// 服务端在发送响应的同时结束 span，等待四个 span 都导出
+	find := func(method string, kind SpanKind) *Span {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		for i := range recorder.spans {
+			if recorder.spans[i].ServiceMethod == method && recorder.spans[i].Kind == kind {
+				return &recorder.spans[i]
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 100 && find("Relay.Sum", SpanKindServer) == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	root, relay := find("Relay.Sum", SpanKindClient), find("Relay.Sum", SpanKindServer)
+	call, sum := find("Foo.Sum", SpanKindClient), find("Foo.Sum", SpanKindServer)
+	_assert(root != nil && relay != nil && call != nil && sum != nil, "expect four spans")
+	_assert(root.ParentSpanID == "" && relay.ParentSpanID == root.SpanID, "expect relay to be a child of the root span")
+	_assert(call.ParentSpanID == relay.SpanID && sum.ParentSpanID == call.SpanID, "expect the nested call to join the trace")
+	for _, span := range []*Span{relay, call, sum} {
+		_assert(span.TraceID == root.TraceID, "expect one trace, got %s and %s", root.TraceID, span.TraceID)
+	}
+	_assert(relay.Peer != "" && !relay.End.Before(relay.Start), "unexpected server span %+v", relay)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_assert(err == nil && sc.Sampled, "failed to parse traceparent: %v", err)
+	_assert(sc.Traceparent() == "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "unexpected traceparent %s", sc.Traceparent())
+	for _, s := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(s)
+		_assert(err != nil, "expect %q to be invalid", s)
+	}
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	_assert(err == nil, "expect future versions to be accepted: %v", err)
+}
+
+func TestFileExporter(t *testing.T) {
+	path := t.TempDir() + "/spans.jsonl"
+	e, err := NewFileExporter(path)
+	_assert(err == nil, "failed to create exporter: %v", err)
+	e.Export(&Span{TraceID: "t", SpanID: "a", ServiceMethod: "Foo.Sum", Kind: SpanKindClient})
+	e.Export(&Span{TraceID: "t", SpanID: "b", ParentSpanID: "a", ServiceMethod: "Foo.Sum", Kind: SpanKindServer})
+	_assert(e.Close() == nil, "failed to close exporter")
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	_assert(len(lines) == 2, "expect two lines, got %q", data)
+	var span Span
+	_assert(json.Unmarshal([]byte(lines[1]), &span) == nil && span.ParentSpanID == "a", "unexpected span %s", lines[1])
+}
+
+type entryRecorder struct {
+	mu      sync.Mutex
+	entries []AccessEntry
+}
+
+func (r *entryRecorder) Write(entry *AccessEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, *entry)
+	return nil
+}
+
+func (r *entryRecorder) take() []AccessEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.entries
+	r.entries = nil
+	return entries
+}
+
+type Quiet int
+
+func (q Quiet) Ping(argv int, reply *int) error {
+	*reply = argv
+	return nil
+}
+
+func TestClient_WithoutTelemetry(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Quiet))
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	clientLog := new(entryRecorder)
+	client.SetAccessLog(NewAccessLog(clientLog))
+
+	var reply int
+	err = client.Call(WithoutTelemetry(context.Background()), "Quiet.Ping", 1, &reply)
+	_assert(err == nil && reply == 1, "expect Quiet.Ping to succeed, got %v", err)
+	_assert(clientMetrics.lookup("Quiet.Ping") == nil, "expect the call not to be counted in client metrics")
+	_assert(len(clientLog.take()) == 0, "expect the call not to be logged")
+}
+
+func TestAccessLog(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Broken))
+	serverLog, clientLog := new(entryRecorder), new(entryRecorder)
+	server.SetAccessLog(NewAccessLog(serverLog))
+	lis, _ := net.Listen("tcp", ":0")
+	go server.Accept(lis)
+	client, err := Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	l := NewAccessLog(clientLog)
+	client.SetAccessLog(l)
+
+	// 服务端在发送响应之后记录，等待记录完成
+	wait := func(n int) []AccessEntry {
+		var entries []AccessEntry
+		for i := 0; i < 100 && len(entries) < n; i++ {
+			entries = append(entries, serverLog.take()...)
+			time.Sleep(time.Millisecond * 10)
+		}
+		return entries
+	}
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Call(context.Background(), "Broken.Fail", 1, &reply)
+	serverEntries, clientEntries := wait(2), clientLog.take()
+	_assert(len(serverEntries) == 2 && len(clientEntries) == 2, "expect two entries on each side, got %d and %d", len(serverEntries), len(clientEntries))
+	for i, method := range []string{"Foo.Sum", "Broken.Fail"} {
+		s, c := serverEntries[i], clientEntries[i]
+		_assert(s.ServiceMethod == method && c.ServiceMethod == method, "unexpected methods %s and %s", s.ServiceMethod, c.ServiceMethod)
+		_assert(s.Side == SpanKindServer && c.Side == SpanKindClient && s.Peer != "" && c.Peer != "", "unexpected peers %+v %+v", s, c)
+		_assert(s.Seq == c.Seq && s.TraceID == c.TraceID && s.TraceID != "", "expect entries of one call to match: %+v %+v", s, c)
+		_assert(s.RequestSize == c.RequestSize && s.RequestSize > 0 && s.ResponseSize > 0, "unexpected sizes %+v %+v", s, c)
+	}
+	_assert(serverEntries[0].Code == CodeOK && clientEntries[0].ResponseSize == serverEntries[0].ResponseSize, "unexpected success entries %+v %+v", serverEntries[0], clientEntries[0])
+	_assert(serverEntries[1].Code == CodeServerError && clientEntries[1].Code == CodeServerError && serverEntries[1].Error == "broken", "unexpected failure entries %+v %+v", serverEntries[1], clientEntries[1])
+
+	// 采样率为0时只记录失败的调用，关闭后不再记录
+	l.SetSampleRate(0)
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Call(context.Background(), "Broken.Fail", 1, &reply)
+	entries := clientLog.take()
+	_assert(len(entries) == 1 && entries[0].Code == CodeServerError, "expect only the failure to be sampled, got %+v", entries)
+	l.SetEnabled(false)
+	_ = client.Call(context.Background(), "Broken.Fail", 1, &reply)
+	_assert(len(clientLog.take()) == 0, "expect no entries when disabled")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := t.TempDir() + "/access.log"
+	f, err := NewRotatingFile(path, 10, 2)
+	_assert(err == nil, "failed to open file: %v", err)
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		_, err := f.Write([]byte(line))
+		_assert(err == nil, "failed to write: %v", err)
+	}
+	_assert(f.Close() == nil, "failed to close file")
+	for name, expected := range map[string]string{path: "dddddd\n", path + ".1": "cccccc\n", path + ".2": "bbbbbb\n"} {
+		data, err := ioutil.ReadFile(name)
+		_assert(err == nil && string(data) == expected, "expect %q in %s, got %q", expected, name, data)
+	}
+	_, err = os.Stat(path + ".3")
+	_assert(os.IsNotExist(err), "expect at most two backups")
+}
+
+// bufferCloser 把写入的数据保存在内存中
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+// 客户端在 Option 之后立即发送请求，两者在同一次读取中到达服务端
+func TestServer_RequestAfterOption(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	conn, serverConn := net.Pipe()
+	defer func() { _ = conn.Close() }()
+	go server.ServeConn(serverConn)
+
+	var buf bufferCloser
+	_ = json.NewEncoder(&buf).Encode(DefaultOption)
+	_ = codec.NewGobCodec(&buf).Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2})
+	_, err := conn.Write(buf.Bytes())
+	_assert(err == nil, "failed to write request: %v", err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	cc := codec.NewGobCodec(conn)
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "expect a response to the request, got %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect reply 3, got %d", reply)
+}
+
+// 只发送了 Option 的空闲连接也会出现在调试页面上，Option 末尾的换行符还没有到达
+func TestServer_IdleConn(t *testing.T) {
+	server := NewServer()
+	conn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	option, _ := json.Marshal(DefaultOption)
+	_, _ = conn.Write(option)
+
+	var data debugData
+	for i := 0; i < 100; i++ {
+		if data = (debugHTTP{server}).debugData(); len(data.Conns) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(len(data.Conns) == 1, "expect the idle connection tracked, got %+v", data.Conns)
+	_ = conn.Close()
+	for i := 0; i < 100; i++ {
+		if data = (debugHTTP{server}).debugData(); len(data.Conns) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(len(data.Conns) == 0, "expect the connection untracked after close, got %+v", data.Conns)
+}
+
+func TestBackoff(t *testing.T) {
+	for n := 1; n < 100; n++ {
+		d := Backoff(time.Second, time.Minute, n)
+		_assert(d > 0 && d <= time.Minute, "backoff out of range: %s", d)
+	}
+	_assert(Backoff(time.Second, time.Minute, 1) < time.Second, "first backoff should not exceed base")
+}
@@ -6,6 +6,7 @@ type Header struct {
 	ServiceMethod	string // format "Service.Method"
 	Seq 			uint64 // sequence number chosen by client
 	Error 			string
+	Metadata		map[string]string // 请求的元数据，见 myrpc.WithMetadata
 }
 
 // Codec 对消息体进行编码解码的接口。抽象出此接口是为了实现不同的codec实例
@@ -16,6 +17,13 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
+// ByteCounter 由能够统计读写字节数的 Codec 实现，返回的是累计值，
+// 在读写一条消息前后各取一次就能得到消息的大小
+type ByteCounter interface {
+	BytesRead() int64
+	BytesWritten() int64
+}
+
 // 构造函数
 type NewCodecFunc func(io.ReadWriteCloser) Codec
 
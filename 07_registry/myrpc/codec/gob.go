@@ -3,8 +3,9 @@ package codec
 import (
 	"bufio"
 	"encoding/gob"
+	"fmt"
 	"io"
-	"log"
+	"sync/atomic"
 )
 
 // GobCodec 实现了Codec接口
@@ -13,20 +14,65 @@ type GobCodec struct {
 	buf		*bufio.Writer
 	encoder	*gob.Encoder
 	decoder	*gob.Decoder
+	read	int64 // 解码器读取的字节数
+	written	int64 // 编码器写入的字节数
 }
 
 var _ Codec = (*GobCodec)(nil)
+var _ ByteCounter = (*GobCodec)(nil)
 
 // NewGobCodec 返回gob编码解码器的实例
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	//使用bufio能够提高效率
 	buf := bufio.NewWriter(conn)
-	return &GobCodec{
+	c := &GobCodec{
 		conn: 		conn,
 		buf:		buf,
-		encoder:	gob.NewEncoder(buf),
-		decoder:	gob.NewDecoder(conn),
 	}
+	// 解码器读到的是实现了io.ByteReader的reader时不会再预读，统计到的就是每条消息的大小
+	c.encoder = gob.NewEncoder(&countingWriter{w: buf, n: &c.written})
+	c.decoder = gob.NewDecoder(&countingReader{r: bufio.NewReader(conn), n: &c.read})
+	return c
+}
+
+// BytesRead 返回解码器累计读取的字节数
+func (c *GobCodec) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// BytesWritten 返回编码器累计写入的字节数
+func (c *GobCodec) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+type countingReader struct {
+	r	*bufio.Reader
+	n	*int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		atomic.AddInt64(r.n, 1)
+	}
+	return b, err
+}
+
+type countingWriter struct {
+	w	io.Writer
+	n	*int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
 }
 
 // ReadHeader 获取Header
@@ -50,14 +96,13 @@ func (c *GobCodec) Write(header *Header, body interface{}) (err error) {
 			_ = c.Close()
 		}
 	}()
+	// 出错时由调用方处理，服务端通过自己的 Logger 输出
 	if err = c.encoder.Encode(header); err != nil {
-		log.Println("rpc: gob error encoding header:", err)
-		return
+		return fmt.Errorf("rpc: gob error encoding header: %w", err)
 	}
 	//fmt.Println("fmt2", body)
 	if err = c.encoder.Encode(body); err != nil {
-		log.Println("rpc: gob error encoding body:", err)
-		return
+		return fmt.Errorf("rpc: gob error encoding body: %w", err)
 	}
 	return
 }
@@ -1,24 +1,79 @@
 package myrpc
 
 import (
+	"MyRpc/07_registry/myrpc/codec"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"sort"
+	"time"
 )
 
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
-		{{range $name, $mtype := .Method}}
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th>
+		{{range $.Windows}}<th align=center>p50 / p90 / p99 ({{.}})</th>{{end}}
+		{{range .Methods}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{range $code, $n := .Errors}}{{$code}}: {{$n}} {{else}}0{{end}}</td>
+			{{range .Latency}}<td align=center>{{.P50}} / {{.P90}} / {{.P99}}</td>{{end}}
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Running}}
+	<hr>
+	Running requests
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Peer</th><th align=center>Elapsed</th>
+		{{range .Running}}
+			<tr>
+			<td align=left font=fixed>{{.ServiceMethod}}</td>
+			<td align=left font=fixed>{{.Peer}}</td>
+			<td align=center>{{.Elapsed}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Conns}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>Peer</th><th align=center>Codec</th><th align=center>Opened</th><th align=center>Age</th>
+		{{range .Conns}}
+			<tr>
+			<td align=left font=fixed>{{.Peer}}</td>
+			<td align=left font=fixed>{{.Codec}}</td>
+			<td align=center>{{.Opened.Format "2006-01-02 15:04:05"}}</td>
+			<td align=center>{{.Age}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Heartbeats}}
+	<hr>
+	Heartbeats
+	<hr>
+		<table>
+		<th align=center>Addr</th><th align=center>Registry</th><th align=center>Last success</th><th align=center>Failures</th><th align=center>Last error</th>
+		{{range .Heartbeats}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=left font=fixed>{{.Registry}}</td>
+			<td align=center>{{if .LastSuccess.IsZero}}never{{else}}{{.LastSuccess.Format "2006-01-02 15:04:05"}}{{end}}</td>
+			<td align=center>{{.ConsecutiveFailures}}</td>
+			<td align=left>{{.LastError}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -32,25 +87,196 @@ type debugHTTP struct {
 	*Server
 }
 
+// 调试页面上计算延迟分位数的时间窗口
+var latencyWindows = []time.Duration{time.Minute, time.Minute * 10}
+
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name    string
+	Methods []debugMethod
+}
+
+type debugMethod struct {
+	Name      string
+	ArgType   string
+	ReplyType string
+	Calls     uint64            // 调用次数
+	Errors    map[string]uint64 // 按错误码统计的失败数
+	Latency   []debugLatency    // 与 latencyWindows 一一对应
+}
+
+// debugLatency 是一个时间窗口内的延迟分位数，JSON 中单位为纳秒
+type debugLatency struct {
+	Window        time.Duration
+	P50, P90, P99 time.Duration
+}
+
+// debugRequest 是一个正在处理的请求
+type debugRequest struct {
+	ServiceMethod string
+	Peer          string
+	Start         time.Time
+	Elapsed       time.Duration
+}
+
+// debugConn 是一个打开的连接
+type debugConn struct {
+	Peer   string
+	Codec  codec.Type
+	Opened time.Time
+	Age    time.Duration
+}
+
+type debugData struct {
+	Windows    []time.Duration
+	Services   []debugService
+	Running    []debugRequest
+	Conns      []debugConn
+	Heartbeats []HeartbeatStatus
 }
 
-// Runs at /debug/geerpc
+// serverConn 是服务端的一个连接
+type serverConn struct {
+	peer   string
+	codec  codec.Type
+	opened time.Time
+}
+
+// runningRequest 是服务端正在处理的一个请求
+type runningRequest struct {
+	serviceMethod string
+	peer          string
+	start         time.Time
+}
+
+func (server *Server) trackConn(peer string, codecType codec.Type) *serverConn {
+	sc := &serverConn{peer: peer, codec: codecType, opened: time.Now()}
+	server.cmu.Lock()
+	defer server.cmu.Unlock()
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	return sc
+}
+
+func (server *Server) untrackConn(sc *serverConn) {
+	server.cmu.Lock()
+	defer server.cmu.Unlock()
+	delete(server.conns, sc)
+}
+
+func (server *Server) trackRequest(serviceMethod, peer string) *runningRequest {
+	r := &runningRequest{serviceMethod: serviceMethod, peer: peer, start: time.Now()}
+	server.cmu.Lock()
+	defer server.cmu.Unlock()
+	if server.running == nil {
+		server.running = make(map[*runningRequest]struct{})
+	}
+	server.running[r] = struct{}{}
+	return r
+}
+
+func (server *Server) untrackRequest(r *runningRequest) {
+	server.cmu.Lock()
+	defer server.cmu.Unlock()
+	delete(server.running, r)
+}
+
+// HeartbeatStatus 服务向注册中心发送心跳的状态
+type HeartbeatStatus struct {
+	Registry            string    // 注册中心地址
+	Addr                string    // 注册的服务地址
+	LastSuccess         time.Time // 最近一次成功的时间
+	LastError           string    // 最近一次失败的原因，成功后清空
+	ConsecutiveFailures int       // 连续失败的次数
+}
+
+// HeartbeatReporter 能够汇报心跳状态，如 registry.Heartbeater
+type HeartbeatReporter interface {
+	HeartbeatStatus() HeartbeatStatus
+}
+
+// AddHeartbeat 在调试页面上展示 h 的心跳状态
+func (server *Server) AddHeartbeat(h HeartbeatReporter) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.heartbeats = append(server.heartbeats, h)
+}
+
+// Runs at /debug/geerpc，带上 ?format=json 时以 JSON 返回相同的数据
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Build a sorted version of the data.
-	var services []debugService
+	data := server.debugData()
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			server.logger.Warnf("rpc server: encode debug data error: %v", err)
+		}
+		return
+	}
+	err := debug.Execute(w, data)
+	if err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
+
+// debugData 收集调试页面上的数据，服务、方法、请求和连接都按顺序排列
+func (server debugHTTP) debugData() debugData {
+	data := debugData{Windows: latencyWindows}
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*service)
-		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
-		})
+		ds := debugService{Name: namei.(string)}
+		for name, mtype := range svc.method {
+			mm := server.serverMetrics().lookup(ds.Name + "." + name)
+			dm := debugMethod{
+				Name:      name,
+				ArgType:   mtype.ArgType.String(),
+				ReplyType: mtype.ReplyType.String(),
+				Calls:     mtype.NumCalls(),
+			}
+			if mm != nil {
+				dm.Errors = mm.errorCounts()
+			}
+			for _, window := range latencyWindows {
+				l := debugLatency{Window: window}
+				if mm != nil {
+					l.P50, l.P90, l.P99 = mm.quantiles(window)
+				}
+				dm.Latency = append(dm.Latency, l)
+			}
+			ds.Methods = append(ds.Methods, dm)
+		}
+		sort.Slice(ds.Methods, func(i, j int) bool { return ds.Methods[i].Name < ds.Methods[j].Name })
+		data.Services = append(data.Services, ds)
 		return true
 	})
-	err := debug.Execute(w, services)
-	if err != nil {
-		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	sort.Slice(data.Services, func(i, j int) bool { return data.Services[i].Name < data.Services[j].Name })
+
+	now := time.Now()
+	server.cmu.Lock()
+	for r := range server.running {
+		data.Running = append(data.Running, debugRequest{
+			ServiceMethod: r.serviceMethod,
+			Peer:          r.peer,
+			Start:         r.start,
+			Elapsed:       now.Sub(r.start),
+		})
+	}
+	for sc := range server.conns {
+		data.Conns = append(data.Conns, debugConn{
+			Peer:   sc.peer,
+			Codec:  sc.codec,
+			Opened: sc.opened,
+			Age:    now.Sub(sc.opened),
+		})
+	}
+	server.cmu.Unlock()
+	sort.Slice(data.Running, func(i, j int) bool { return data.Running[i].Start.Before(data.Running[j].Start) })
+	sort.Slice(data.Conns, func(i, j int) bool { return data.Conns[i].Opened.Before(data.Conns[j].Opened) })
+
+	server.mu.Lock()
+	for _, h := range server.heartbeats {
+		data.Heartbeats = append(data.Heartbeats, h.HeartbeatStatus())
 	}
+	server.mu.Unlock()
+	return data
 }
@@ -0,0 +1,42 @@
+package myrpc
+
+import "sync/atomic"
+
+// HealthServiceMethod 是内置的健康检查方法，通过 RegisterHealth 注册
+const HealthServiceMethod = "Health.Check"
+
+// Health 是内置的健康检查服务，客户端可以用它探测服务是否可用
+type Health struct {
+	server *Server
+}
+
+type HealthArgs struct{}
+
+type HealthReply struct {
+	Serving bool // 服务是否在接受请求，下线前可以通过 SetServing(false) 让客户端不再选择它
+}
+
+// Check 返回服务的状态
+func (h *Health) Check(args HealthArgs, reply *HealthReply) error {
+	reply.Serving = atomic.LoadInt32(&h.server.notServing) == 0
+	return nil
+}
+
+// RegisterHealth 注册内置的 Health 服务，已经注册了同名的服务时返回错误
+func (server *Server) RegisterHealth() error {
+	return server.Register(&Health{server: server})
+}
+
+// RegisterHealth 在 DefaultServer 上注册内置的 Health 服务
+func RegisterHealth() error {
+	return DefaultServer.RegisterHealth()
+}
+
+// SetServing 设置健康检查返回的状态，如在下线前设置为 false，让客户端不再发送新的请求
+func (server *Server) SetServing(serving bool) {
+	var v int32
+	if !serving {
+		v = 1
+	}
+	atomic.StoreInt32(&server.notServing, v)
+}
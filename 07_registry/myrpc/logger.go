@@ -0,0 +1,111 @@
+package myrpc
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Level 是日志的级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff // 不输出任何日志
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	case LevelOff:
+		return "OFF"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+// Logger 输出日志，需要能被并发调用。Server、Client、XClient 和 MyRegistry 都可以设置各自的 Logger
+type Logger interface {
+	Logf(level Level, format string, args ...interface{})
+}
+
+// stdLogger 通过标准库的 log.Logger 输出不低于 level 的日志
+type stdLogger struct {
+	out   *log.Logger
+	level Level
+}
+
+// NewStdLogger 返回通过 out 输出不低于 level 的日志的 Logger，out 为 nil 时使用 log 包的默认输出
+func NewStdLogger(out *log.Logger, level Level) Logger {
+	return &stdLogger{out: out, level: level}
+}
+
+func (l *stdLogger) Logf(level Level, format string, args ...interface{}) {
+	if level < l.level || level >= LevelOff {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if l.out == nil {
+		_ = log.Output(3, msg)
+		return
+	}
+	_ = l.out.Output(3, msg)
+}
+
+// DefaultLogger 通过 log 包输出 Info 及以上级别的日志，没有设置 Logger 时使用
+var DefaultLogger = NewStdLogger(nil, LevelInfo)
+
+// NopLogger 丢弃所有日志
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Logf(Level, string, ...interface{}) {}
+
+// LoggerHolder 保存一个可以在运行时替换的 Logger，零值使用 DefaultLogger
+type LoggerHolder struct {
+	v atomic.Value
+}
+
+type loggerBox struct {
+	logger Logger
+}
+
+// Store 替换 Logger，为 nil 时使用 DefaultLogger
+func (h *LoggerHolder) Store(l Logger) {
+	h.v.Store(loggerBox{logger: l})
+}
+
+// Load 返回当前的 Logger
+func (h *LoggerHolder) Load() Logger {
+	if b, ok := h.v.Load().(loggerBox); ok && b.logger != nil {
+		return b.logger
+	}
+	return DefaultLogger
+}
+
+func (h *LoggerHolder) Debugf(format string, args ...interface{}) {
+	h.Load().Logf(LevelDebug, format, args...)
+}
+
+func (h *LoggerHolder) Infof(format string, args ...interface{}) {
+	h.Load().Logf(LevelInfo, format, args...)
+}
+
+func (h *LoggerHolder) Warnf(format string, args ...interface{}) {
+	h.Load().Logf(LevelWarn, format, args...)
+}
+
+func (h *LoggerHolder) Errorf(format string, args ...interface{}) {
+	h.Load().Logf(LevelError, format, args...)
+}
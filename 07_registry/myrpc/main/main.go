@@ -39,7 +39,7 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	lis, _ := net.Listen("tcp", ":0")
 	server := myrpc.NewServer()
 	server.Register(&foo)
-	registry.Heartbeat(registryAddr, "tcp@" + lis.Addr().String(), 0)
+	server.AddHeartbeat(registry.Heartbeat(registryAddr, "tcp@" + lis.Addr().String(), 0))
 	wg.Done()
 	server.Accept(lis)
 }
@@ -0,0 +1,24 @@
+package myrpc
+
+import "context"
+
+type metadataKey struct{}
+
+// WithMetadata 返回带有请求元数据的 ctx，与 ctx 中已有的元数据合并。
+// Client.Call 会把元数据放在请求头中发给服务端，XClient 的路由规则也根据它选择服务
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	merged := make(map[string]string, len(md))
+	for k, v := range Metadata(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// Metadata 返回 ctx 中的请求元数据，不能修改返回的 map
+func Metadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
@@ -0,0 +1,463 @@
+package myrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// 延迟直方图的上界，单位为秒
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 错误码，用于按类型统计失败的调用
+const (
+	CodeServerError = "server_error" // 服务方法返回了错误
+	CodeTimeout     = "timeout"      // 服务端处理超时或客户端等待超时
+	CodeCanceled    = "canceled"     // 客户端取消了调用
+	CodeBadRequest  = "bad_request"  // 服务端无法解析请求参数
+	CodeShutdown    = "shutdown"     // 连接已经关闭
+	CodeTransport   = "transport"    // 读写连接失败
+)
+
+// ErrorCode 返回客户端调用失败的错误码，err为nil时返回空字符串
+func ErrorCode(err error) string {
+	var serverErr ServerError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &serverErr):
+		if strings.Contains(string(serverErr), "handle timeout") {
+			return CodeTimeout
+		}
+		return CodeServerError
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, ErrShutdown):
+		return CodeShutdown
+	default:
+		return CodeTransport
+	}
+}
+
+// methodMetrics 记录一个方法的调用情况
+type methodMetrics struct {
+	inflight int64 // 正在进行的调用数
+	mu       sync.Mutex
+	requests uint64
+	errors   map[string]uint64   // 按错误码统计的失败数
+	buckets  []uint64            // 落在每个区间的调用数，最后一个为 +Inf
+	sum      float64             // 延迟之和，单位为秒
+	recent   []*slidingHistogram // 每个 latencyWindows 内的延迟直方图，用于计算分位数
+}
+
+func (m *methodMetrics) begin() {
+	atomic.AddInt64(&m.inflight, 1)
+}
+
+// end 结束一次调用，code为空表示成功
+func (m *methodMetrics) end(latency time.Duration, code string) {
+	atomic.AddInt64(&m.inflight, -1)
+	seconds := latency.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if code != "" {
+		m.errors[code]++
+	}
+	m.buckets[i]++
+	m.sum += seconds
+	now := time.Now()
+	for _, h := range m.recent {
+		h.add(now, latency)
+	}
+}
+
+// fail 记录一次没有被处理的失败请求，不计入延迟
+func (m *methodMetrics) fail(code string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	m.errors[code]++
+}
+
+// errorCounts 返回按错误码统计的失败数的副本
+func (m *methodMetrics) errorCounts() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]uint64, len(m.errors))
+	for code, n := range m.errors {
+		counts[code] = n
+	}
+	return counts
+}
+
+// quantiles 返回最近 window 内延迟的 p50、p90、p99，没有样本或没有记录该窗口时为0
+func (m *methodMetrics) quantiles(window time.Duration) (p50, p90, p99 time.Duration) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, h := range m.recent {
+		if h.window == window {
+			return h.quantiles(now)
+		}
+	}
+	return 0, 0, 0
+}
+
+// 计算分位数的延迟区间的上界，从 100µs 开始每个增大 20%，超过 60s 的落在最后一个区间。
+// 分位数在区间内线性插值，相对误差不超过 20%
+var quantileBuckets = func() []time.Duration {
+	var bounds []time.Duration
+	for b := float64(100 * time.Microsecond); b < float64(time.Minute); b *= 1.2 {
+		bounds = append(bounds, time.Duration(b))
+	}
+	return append(bounds, time.Minute)
+}()
+
+// 每个时间窗口分成的时间片数，窗口实际覆盖的时间在 window 减去一个时间片与 window 之间
+const windowSlots = 10
+
+// slidingHistogram 是最近 window 内的延迟直方图，按时间片记录，过期的时间片清空后复用。
+// 被 methodMetrics.mu 保护
+type slidingHistogram struct {
+	window time.Duration
+	slots  []latencySlot
+}
+
+// latencySlot 是一个时间片内的延迟直方图
+type latencySlot struct {
+	start  int64    // 时间片的序号，为开始时间除以时间片的长度
+	counts []uint64 // 落在每个区间的调用数，最后一个为超过 quantileBuckets 的调用
+}
+
+func newSlidingHistogram(window time.Duration) *slidingHistogram {
+	h := &slidingHistogram{window: window, slots: make([]latencySlot, windowSlots)}
+	for i := range h.slots {
+		h.slots[i].start = -1
+		h.slots[i].counts = make([]uint64, len(quantileBuckets)+1)
+	}
+	return h
+}
+
+func (h *slidingHistogram) slotDuration() int64 {
+	return int64(h.window) / windowSlots
+}
+
+func (h *slidingHistogram) add(now time.Time, latency time.Duration) {
+	start := now.UnixNano() / h.slotDuration()
+	slot := &h.slots[start%windowSlots]
+	if slot.start != start {
+		slot.start = start
+		for i := range slot.counts {
+			slot.counts[i] = 0
+		}
+	}
+	i := sort.Search(len(quantileBuckets), func(i int) bool { return quantileBuckets[i] >= latency })
+	slot.counts[i]++
+}
+
+// quantiles 合并 now 之前一个窗口内的时间片，返回 p50、p90、p99
+func (h *slidingHistogram) quantiles(now time.Time) (p50, p90, p99 time.Duration) {
+	current := now.UnixNano() / h.slotDuration()
+	counts := make([]uint64, len(quantileBuckets)+1)
+	var total uint64
+	for _, slot := range h.slots {
+		if slot.start < 0 || current-slot.start >= windowSlots {
+			continue
+		}
+		for i, n := range slot.counts {
+			counts[i] += n
+			total += n
+		}
+	}
+	if total == 0 {
+		return 0, 0, 0
+	}
+	at := func(q float64) time.Duration {
+		rank := q * float64(total)
+		var seen uint64
+		for i, n := range counts {
+			if n == 0 || float64(seen+n) < rank {
+				seen += n
+				continue
+			}
+			var lower time.Duration
+			if i > 0 {
+				lower = quantileBuckets[i-1]
+			}
+			if i == len(quantileBuckets) {
+				return lower
+			}
+			return lower + time.Duration(float64(quantileBuckets[i]-lower)*(rank-float64(seen))/float64(n))
+		}
+		return quantileBuckets[len(quantileBuckets)-1]
+	}
+	return at(0.5), at(0.9), at(0.99)
+}
+
+// rpcMetrics 是服务端或客户端的指标，以方法为标签
+type rpcMetrics struct {
+	bytesIn  uint64 // 从连接读取的字节数
+	bytesOut uint64 // 向连接写入的字节数
+	conns    int64  // 打开的连接数
+	mu       sync.Mutex
+	methods  map[string]*methodMetrics
+}
+
+func newRPCMetrics() *rpcMetrics {
+	return &rpcMetrics{methods: make(map[string]*methodMetrics)}
+}
+
+// clientMetrics 由所有的 Client 共享
+var clientMetrics = newRPCMetrics()
+
+func (m *rpcMetrics) method(serviceMethod string) *methodMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm, ok := m.methods[serviceMethod]
+	if !ok {
+		mm = &methodMetrics{
+			errors:  make(map[string]uint64),
+			buckets: make([]uint64, len(latencyBuckets)+1),
+		}
+		for _, window := range latencyWindows {
+			mm.recent = append(mm.recent, newSlidingHistogram(window))
+		}
+		m.methods[serviceMethod] = mm
+	}
+	return mm
+}
+
+// lookup 返回已经记录的方法的指标，方法还没有被调用时返回 nil，不会在指标页面上增加方法
+func (m *rpcMetrics) lookup(serviceMethod string) *methodMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.methods[serviceMethod]
+}
+
+// countingConn 统计连接读写的字节数，并在打开和关闭时更新连接数
+type countingConn struct {
+	net.Conn
+	metrics *rpcMetrics
+	once    sync.Once
+}
+
+func (m *rpcMetrics) countConn(conn net.Conn) net.Conn {
+	atomic.AddInt64(&m.conns, 1)
+	return &countingConn{Conn: conn, metrics: m}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.metrics.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.metrics.bytesOut, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.metrics.conns, -1) })
+	return c.Conn.Close()
+}
+
+// countingReadWriteCloser 与 countingConn 相同，用于不是 net.Conn 的连接
+type countingReadWriteCloser struct {
+	io.ReadWriteCloser
+	metrics *rpcMetrics
+	once    sync.Once
+}
+
+func (m *rpcMetrics) countReadWriteCloser(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if c, ok := conn.(net.Conn); ok {
+		return m.countConn(c)
+	}
+	atomic.AddInt64(&m.conns, 1)
+	return &countingReadWriteCloser{ReadWriteCloser: conn, metrics: m}
+}
+
+func (c *countingReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddUint64(&c.metrics.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countingReadWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&c.metrics.bytesOut, uint64(n))
+	return n, err
+}
+
+func (c *countingReadWriteCloser) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.metrics.conns, -1) })
+	return c.ReadWriteCloser.Close()
+}
+
+// write 以 prefix 为前缀输出所有指标，方法按名称排序
+func (m *rpcMetrics) write(w *MetricsWriter, prefix string) {
+	type snapshot struct {
+		name     string
+		inflight int64
+		requests uint64
+		errors   map[string]uint64
+		buckets  []uint64
+		sum      float64
+	}
+	// 先复制快照，保证同一次输出中各个指标是一致的
+	m.mu.Lock()
+	snaps := make([]snapshot, 0, len(m.methods))
+	for name, mm := range m.methods {
+		errors := mm.errorCounts()
+		mm.mu.Lock()
+		s := snapshot{
+			name:     name,
+			inflight: atomic.LoadInt64(&mm.inflight),
+			requests: mm.requests,
+			errors:   errors,
+			buckets:  append([]uint64(nil), mm.buckets...),
+			sum:      mm.sum,
+		}
+		mm.mu.Unlock()
+		snaps = append(snaps, s)
+	}
+	m.mu.Unlock()
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].name < snaps[j].name })
+
+	w.Family(prefix+"_requests_total", "counter", "Completed calls by method.")
+	for _, s := range snaps {
+		w.Sample(prefix+"_requests_total", float64(s.requests), "method", s.name)
+	}
+	w.Family(prefix+"_errors_total", "counter", "Failed calls by method and error code.")
+	for _, s := range snaps {
+		codes := make([]string, 0, len(s.errors))
+		for code := range s.errors {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			w.Sample(prefix+"_errors_total", float64(s.errors[code]), "method", s.name, "code", code)
+		}
+	}
+	w.Family(prefix+"_request_duration_seconds", "histogram", "Call latency by method.")
+	for _, s := range snaps {
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += s.buckets[i]
+			w.Sample(prefix+"_request_duration_seconds_bucket", float64(cumulative), "method", s.name, "le", formatFloat(le))
+		}
+		cumulative += s.buckets[len(latencyBuckets)]
+		w.Sample(prefix+"_request_duration_seconds_bucket", float64(cumulative), "method", s.name, "le", "+Inf")
+		w.Sample(prefix+"_request_duration_seconds_sum", s.sum, "method", s.name)
+		w.Sample(prefix+"_request_duration_seconds_count", float64(cumulative), "method", s.name)
+	}
+	w.Family(prefix+"_inflight_requests", "gauge", "Calls in progress by method.")
+	for _, s := range snaps {
+		w.Sample(prefix+"_inflight_requests", float64(s.inflight), "method", s.name)
+	}
+	w.Family(prefix+"_received_bytes_total", "counter", "Bytes read from connections.")
+	w.Sample(prefix+"_received_bytes_total", float64(atomic.LoadUint64(&m.bytesIn)))
+	w.Family(prefix+"_sent_bytes_total", "counter", "Bytes written to connections.")
+	w.Sample(prefix+"_sent_bytes_total", float64(atomic.LoadUint64(&m.bytesOut)))
+	w.Family(prefix+"_open_connections", "gauge", "Connections currently open.")
+	w.Sample(prefix+"_open_connections", float64(atomic.LoadInt64(&m.conns)))
+}
+
+// MetricsWriter 按 Prometheus 的文本格式输出指标，记录第一个写入错误
+type MetricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w}
+}
+
+// Family 输出一组指标的说明和类型，同一组的 Sample 需要紧跟在后面
+func (w *MetricsWriter) Family(name, typ, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample 输出一个样本，labels 为依次排列的标签名和标签值
+func (w *MetricsWriter) Sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	w.printf("%s %s\n", b.String(), formatFloat(value))
+}
+
+// Err 返回第一个写入错误
+func (w *MetricsWriter) Err() error {
+	return w.err
+}
+
+func (w *MetricsWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Collector 能够输出自己的指标，如 xclient.XClient。不同的 Collector 不能输出同名的指标
+type Collector interface {
+	WriteMetrics(w *MetricsWriter)
+}
+
+// AddCollector 在指标页面上输出 c 的指标
+func (server *Server) AddCollector(c Collector) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.collectors = append(server.collectors, c)
+}
+
+type metricsHTTP struct {
+	*Server
+}
+
+// Runs at /metrics，输出服务端、本进程所有 Client 以及添加的 Collector 的指标
+func (server metricsHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := NewMetricsWriter(w)
+	server.serverMetrics().write(mw, "myrpc_server")
+	clientMetrics.write(mw, "myrpc_client")
+	server.mu.Lock()
+	collectors := append([]Collector(nil), server.collectors...)
+	server.mu.Unlock()
+	for _, c := range collectors {
+		c.WriteMetrics(mw)
+	}
+}
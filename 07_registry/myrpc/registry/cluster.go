@@ -0,0 +1,293 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyncInterval = time.Second * 30
+	// 每个节点待转发的变化数量上限，超出后丢弃，由定期同步补齐
+	peerQueueSize = 1024
+	// 重新解析节点主机名的间隔
+	peerResolveInterval = time.Minute
+)
+
+// lookupHost 解析节点的主机名，测试时替换
+var lookupHost = net.LookupHost
+
+// cluster 保存集群中的其他注册中心节点。
+// 本节点收到的注册、心跳和注销会异步转发给所有节点；此外每隔一段时间随机
+// 从一个节点拉取全量状态进行合并，以修复转发失败或节点重启造成的差异。
+// 合并时以心跳时间为准，较新的心跳或注销覆盖较旧的
+type cluster struct {
+	peers    []*peer
+	interval time.Duration
+	mu       sync.Mutex          // protect following
+	ips      map[string][]net.IP // 每个节点的主机解析出的IP，定期刷新
+}
+
+type peer struct {
+	addr  string
+	host  string // addr 中的主机，用于识别该节点转发过来的变化
+	queue chan storeRecord
+}
+
+// clusterState 是一个节点的全量状态
+type clusterState struct {
+	Servers    []storeRecord `json:"servers"`
+	Tombstones []storeRecord `json:"tombstones"`
+}
+
+// JoinCluster 把本节点加入由peers组成的集群，peers为其他节点的注册中心地址，
+// interval为定期同步全量状态的间隔，为0时使用默认值。只能调用一次。
+// 加入集群后只接受来自peers中主机的转发，未加入集群时拒绝所有转发。
+// peers中的主机名在加入时解析，之后每隔 peerResolveInterval 重新解析
+func (r *MyRegistry) JoinCluster(peers []string, interval time.Duration) {
+	if interval == 0 {
+		interval = defaultSyncInterval
+	}
+	c := &cluster{interval: interval, ips: make(map[string][]net.IP)}
+	for _, addr := range peers {
+		p := &peer{addr: addr, queue: make(chan storeRecord, peerQueueSize)}
+		if u, err := url.Parse(addr); err == nil {
+			p.host = u.Hostname()
+		}
+		c.peers = append(c.peers, p)
+		go r.forward(p)
+	}
+	r.resolvePeers(c)
+	r.mu.Lock()
+	r.cluster = c
+	r.mu.Unlock()
+	go r.syncLoop(c)
+	go r.resolveLoop(c)
+}
+
+// resolvePeers 解析每个节点的主机，解析失败时保留上一次的结果
+func (r *MyRegistry) resolvePeers(c *cluster) {
+	for _, p := range c.peers {
+		if p.host == "" {
+			continue
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(p.host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			addrs, err := lookupHost(p.host)
+			if err != nil {
+				r.logger.Warnf("rpc registry: resolve peer %s err: %v", p.addr, err)
+				continue
+			}
+			for _, addr := range addrs {
+				if ip := net.ParseIP(addr); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		c.mu.Lock()
+		c.ips[p.host] = ips
+		c.mu.Unlock()
+	}
+}
+
+// resolveLoop 定期重新解析节点的主机，跟上节点IP的变化
+func (r *MyRegistry) resolveLoop(c *cluster) {
+	if len(c.peers) == 0 {
+		return
+	}
+	t := time.NewTicker(peerResolveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			r.resolvePeers(c)
+		}
+	}
+}
+
+// replicate 把本地的变化转发给集群中的其他节点
+func (r *MyRegistry) replicate(record storeRecord) {
+	r.mu.Lock()
+	c := r.cluster
+	r.mu.Unlock()
+	if c == nil {
+		return
+	}
+	for _, p := range c.peers {
+		select {
+		case p.queue <- record:
+		default:
+			r.logger.Warnf("rpc registry: replication queue full, drop %s %s for %s", record.Op, record.Addr, p.addr)
+		}
+	}
+}
+
+// forward 按顺序把变化发送给节点p
+func (r *MyRegistry) forward(p *peer) {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case record := <-p.queue:
+			if err := sendReplica(p.addr, record); err != nil {
+				r.logger.Warnf("rpc registry: replicate to %s err: %v", p.addr, err)
+			}
+		}
+	}
+}
+
+func (r *MyRegistry) syncLoop(c *cluster) {
+	if len(c.peers) == 0 {
+		return
+	}
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			p := c.peers[rand.Intn(len(c.peers))]
+			if err := r.syncFrom(p.addr); err != nil {
+				r.logger.Warnf("rpc registry: sync from %s err: %v", p.addr, err)
+			}
+		}
+	}
+}
+
+// syncFrom 拉取节点addr的全量状态并与本地合并
+func (r *MyRegistry) syncFrom(addr string) error {
+	resp, err := registryClient.Get(strings.TrimSuffix(addr, "/") + "/state")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var state clusterState
+	if err = json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return err
+	}
+	r.merge(state)
+	return nil
+}
+
+// merge 合并其他节点的状态
+func (r *MyRegistry) merge(state clusterState) {
+	for _, record := range state.Servers {
+		r.putServerAt(record.Addr, record.Time, true)
+	}
+	for _, record := range state.Tombstones {
+		r.removeServerAt(record.Addr, record.Time, true)
+	}
+}
+
+func (r *MyRegistry) state() clusterState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := clusterState{
+		Servers:    make([]storeRecord, 0, len(r.servers)),
+		Tombstones: make([]storeRecord, 0, len(r.tombstones)),
+	}
+	for addr, server := range r.servers {
+		// 未确认的服务可能已经不存在了，不传播给其他节点
+		if !server.unconfirmed {
+			state.Servers = append(state.Servers, storeRecord{Op: opPut, Addr: addr, Time: server.start})
+		}
+	}
+	for addr, t := range r.tombstones {
+		state.Tombstones = append(state.Tombstones, storeRecord{Op: opDel, Addr: addr, Time: t})
+	}
+	return state
+}
+
+// serveState 返回本节点的全量状态，供其他节点合并
+func (r *MyRegistry) serveState(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(r.state())
+}
+
+// isPeer 判断 remoteAddr 是否是集群中某个节点的地址，只使用已经解析好的IP，不会解析主机名
+func (c *cluster) isPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ips := range c.ips {
+		for _, peerIP := range ips {
+			if ip.Equal(peerIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveReplica 处理其他节点转发过来的变化，只接受集群中的节点
+func (r *MyRegistry) serveReplica(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	c := r.cluster
+	r.mu.Unlock()
+	if c == nil || !c.isPeer(req.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	addr := req.Header.Get("X-Myrpc-Server")
+	t, err := time.Parse(time.RFC3339Nano, req.Header.Get("X-Myrpc-Time"))
+	if addr == "" || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "POST":
+		r.putServerAt(addr, t, true)
+	case "DELETE":
+		r.removeServerAt(addr, t, true)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func sendReplica(registry string, record storeRecord) error {
+	method := "POST"
+	if record.Op == opDel {
+		method = "DELETE"
+	}
+	req, _ := http.NewRequest(method, registry, nil)
+	req.Header.Set("X-Myrpc-Server", record.Addr)
+	req.Header.Set("X-Myrpc-Replica", "1")
+	req.Header.Set("X-Myrpc-Time", record.Time.Format(time.RFC3339Nano))
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCluster 在进程内启动n个注册中心节点
+func startCluster(n int, interval time.Duration) ([]*MyRegistry, []*httptest.Server) {
+	nodes := make([]*MyRegistry, n)
+	servers := make([]*httptest.Server, n)
+	for i := range nodes {
+		nodes[i] = New(time.Minute)
+		servers[i] = httptest.NewServer(nodes[i])
+	}
+	for i, node := range nodes {
+		var peers []string
+		for j, ts := range servers {
+			if j != i {
+				peers = append(peers, ts.URL)
+			}
+		}
+		node.JoinCluster(peers, interval)
+	}
+	return nodes, servers
+}
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second * 2)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return true
+}
+
+func TestCluster_Replicate(t *testing.T) {
+	nodes, servers := startCluster(3, time.Hour)
+	defer func() {
+		for i := range nodes {
+			servers[i].Close()
+			_ = nodes[i].Close()
+		}
+	}()
+
+	nodes[0].putServer("tcp@a")
+	_assert(waitFor(func() bool {
+		return len(nodes[1].aliveServers()) == 1 && len(nodes[2].aliveServers()) == 1
+	}), "expect registration replicated to every node")
+
+	_ = nodes[1].removeServer("tcp@a")
+	_assert(waitFor(func() bool {
+		return len(nodes[0].aliveServers()) == 0 && len(nodes[2].aliveServers()) == 0
+	}), "expect deregistration replicated to every node")
+}
+
+func TestCluster_Failover(t *testing.T) {
+	nodes, servers := startCluster(3, time.Millisecond*50)
+	defer func() {
+		for i := range nodes {
+			servers[i].Close()
+			_ = nodes[i].Close()
+		}
+	}()
+	registries := []string{servers[0].URL, servers[1].URL, servers[2].URL}
+
+	h, err := HeartbeatCluster(registries, "tcp@a", &HeartbeatOption{
+		Duration:   time.Millisecond * 20,
+		MinBackoff: time.Millisecond * 5,
+	})
+	_assert(err == nil, "failed to start heartbeat: %v", err)
+	defer h.Stop()
+	_assert(waitFor(func() bool { return len(nodes[2].aliveServers()) == 1 }), "expect tcp@a replicated")
+
+	// 关掉心跳正在使用的节点，心跳应当切换到其他节点
+	servers[0].Close()
+	_ = nodes[0].Close()
+	_assert(waitFor(func() bool {
+		return h.HeartbeatStatus().Registry != servers[0].URL
+	}), "expect heartbeat fail over to another registry")
+
+	// 新节点注册到剩下的节点上，通过转发和定期同步都能到达另一个节点
+	nodes[2].putServer("tcp@b")
+	_assert(waitFor(func() bool {
+		return fmt.Sprint(nodes[1].aliveServers()) == "[tcp@a tcp@b]"
+	}), "expect surviving nodes converge, got %v", nodes[1].aliveServers())
+
+	// 再关掉一个节点，剩下的节点仍然持有完整的服务列表
+	servers[1].Close()
+	_ = nodes[1].Close()
+	_assert(waitFor(func() bool {
+		return h.HeartbeatStatus().Registry == servers[2].URL && h.HeartbeatStatus().ConsecutiveFailures == 0
+	}), "expect heartbeat on the last registry")
+	_assert(fmt.Sprint(nodes[2].aliveServers()) == "[tcp@a tcp@b]", "expect last node keep every server")
+}
+
+func TestCluster_SyncRepairs(t *testing.T) {
+	a, b := New(time.Minute), New(time.Minute)
+	defer a.Close()
+	defer b.Close()
+	tsA := httptest.NewServer(a)
+	defer tsA.Close()
+	// a 不转发，b 通过同步得到 a 的状态
+	a.putServer("tcp@x")
+	a.putServer("tcp@y")
+	_ = a.removeServer("tcp@y")
+	b.putServer("tcp@y")
+	time.Sleep(time.Millisecond)
+	_ = a.removeServer("tcp@y")
+	_assert(b.syncFrom(tsA.URL) == nil, "failed to sync")
+	_assert(fmt.Sprint(b.aliveServers()) == "[tcp@x]", "expect newer deregistration win, got %v", b.aliveServers())
+}
+
+func TestCluster_RejectReplica(t *testing.T) {
+	_, err := HeartbeatCluster(nil, "tcp@a", nil)
+	_assert(err != nil, "expect error without registries")
+
+	r := New(time.Minute)
+	defer r.Close()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	// 没有加入集群，或者请求不是来自集群中的节点时，转发都被拒绝
+	record := storeRecord{Op: opPut, Addr: "tcp@a", Time: time.Now()}
+	_assert(sendReplica(ts.URL, record) != nil, "expect replica rejected outside a cluster")
+	r.JoinCluster([]string{"http://192.0.2.1:1"}, time.Hour)
+	_assert(sendReplica(ts.URL, record) != nil, "expect replica rejected from a non-peer")
+	_assert(len(r.aliveServers()) == 0, "expect no server registered by rejected replicas")
+
+	resp, err := http.Post(ts.URL, "", nil)
+	_assert(err == nil && resp.StatusCode == http.StatusInternalServerError, "expect normal requests unaffected")
+	_ = resp.Body.Close()
+}
+
+func TestCluster_ResolvePeersOnce(t *testing.T) {
+	var lookups int32
+	lookupHost = func(host string) ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []string{"127.0.0.1"}, nil
+	}
+	defer func() { lookupHost = net.LookupHost }()
+
+	r := New(time.Minute)
+	defer r.Close()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	// 主机名在加入集群时解析一次，之后的转发只比较缓存的IP
+	r.JoinCluster([]string{"http://peer.example:1"}, time.Hour)
+	for i := 0; i < 5; i++ {
+		record := storeRecord{Op: opPut, Addr: fmt.Sprintf("tcp@%d", i), Time: time.Now()}
+		_assert(sendReplica(ts.URL, record) == nil, "expect replica from a resolved peer accepted")
+	}
+	_assert(len(r.aliveServers()) == 5, "expect 5 replicated servers, got %v", r.aliveServers())
+	_assert(atomic.LoadInt32(&lookups) == 1, "expect peer resolved once, got %d lookups", lookups)
+
+	// 重新解析后节点的IP变化生效，解析失败时保留上一次的结果
+	lookupHost = func(host string) ([]string, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+	r.mu.Lock()
+	c := r.cluster
+	r.mu.Unlock()
+	r.resolvePeers(c)
+	_assert(c.isPeer("127.0.0.1:1234"), "expect last resolved IPs kept on lookup failure")
+	lookupHost = func(host string) ([]string, error) {
+		return []string{"192.0.2.1"}, nil
+	}
+	r.resolvePeers(c)
+	_assert(!c.isPeer("127.0.0.1:1234") && c.isPeer("192.0.2.1:1234"), "expect refreshed IPs to replace the old ones")
+}
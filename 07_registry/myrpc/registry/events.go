@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType 注册中心中服务实例的变化类型
+type EventType int
+
+const (
+	EventRegistered   EventType = iota // 新的服务实例注册
+	EventRenewed                       // 已有的服务实例发送了心跳
+	EventExpired                       // 服务实例超时未发送心跳，被移除
+	EventDeregistered                  // 服务实例主动注销
+)
+
+var eventTypeNames = []string{"registered", "renewed", "expired", "deregistered"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+	return eventTypeNames[t]
+}
+
+// MarshalJSON 以名称的形式输出事件类型
+func (t EventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON 解析 MarshalJSON 输出的名称
+func (t *EventType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for i, n := range eventTypeNames {
+		if n == name {
+			*t = EventType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("rpc registry: unknown event type %q", name)
+}
+
+// Event 注册中心的一条事件
+type Event struct {
+	Seq  uint64    `json:"seq"` // 递增的序号，从 1 开始
+	Type EventType `json:"type"`
+	Addr string    `json:"addr"`
+	Time time.Time `json:"time"`
+}
+
+const defaultEventLogSize = 1024
+
+// eventLog 保存最近的事件，超出容量后覆盖最旧的事件
+type eventLog struct {
+	mu     sync.Mutex
+	buf    []Event
+	next   int    // 下一条事件在 buf 中的位置
+	seq    uint64 // 最后一条事件的序号
+	hooks  map[int]func(Event)
+	hookID int
+	// 服务列表的版本，注册、过期和注销时递增，心跳不改变版本
+	version uint64
+	changed chan struct{} // 版本变化时关闭并替换
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		buf:     make([]Event, 0, size),
+		hooks:   make(map[int]func(Event)),
+		changed: make(chan struct{}),
+	}
+}
+
+// append 记录事件并依次通知订阅者。订阅者在锁外被调用
+func (l *eventLog) append(events ...Event) {
+	l.add(events...)()
+}
+
+// add 为事件分配序号并记录，返回通知订阅者的函数。
+// 调用方在持有自己的锁时调用 add，保证序号与状态变化的顺序一致，释放锁之后再通知
+func (l *eventLog) add(events ...Event) (notify func()) {
+	if len(events) == 0 {
+		return func() {}
+	}
+	l.mu.Lock()
+	changed := false
+	for i := range events {
+		if events[i].Type != EventRenewed {
+			changed = true
+		}
+		l.seq++
+		events[i].Seq = l.seq
+		if len(l.buf) < cap(l.buf) {
+			l.buf = append(l.buf, events[i])
+		} else {
+			l.buf[l.next] = events[i]
+		}
+		l.next = (l.next + 1) % cap(l.buf)
+	}
+	if changed {
+		l.version++
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+	hooks := make([]func(Event), 0, len(l.hooks))
+	for _, hook := range l.hooks {
+		hooks = append(hooks, hook)
+	}
+	l.mu.Unlock()
+	return func() {
+		for _, e := range events {
+			for _, hook := range hooks {
+				hook(e)
+			}
+		}
+	}
+}
+
+// since 返回序号大于 seq 的事件，最多 limit 条，limit <= 0 表示不限制
+func (l *eventLog) since(seq uint64, limit int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.buf)
+	// 最旧的事件位于 next（buf 已满时）或 0
+	start := 0
+	if n == cap(l.buf) {
+		start = l.next
+	}
+	events := make([]Event, 0)
+	for i := 0; i < n; i++ {
+		e := l.buf[(start+i)%n]
+		if e.Seq <= seq {
+			continue
+		}
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// membership 返回服务列表当前的版本，以及版本变化时会被关闭的channel
+func (l *eventLog) membership() (uint64, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version, l.changed
+}
+
+func (l *eventLog) subscribe(hook func(Event)) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.hookID
+	l.hookID++
+	l.hooks[id] = hook
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.hooks, id)
+	}
+}
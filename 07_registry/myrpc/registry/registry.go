@@ -1,9 +1,15 @@
 package registry
 
 import (
-	"log"
+	"MyRpc/07_registry/myrpc"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,113 +19,594 @@ type MyRegistry struct {
 	timeout	time.Duration
 	mu 		sync.Mutex
 	servers	map[string]*ServerItem
+	events	*eventLog		// 最近的事件
+	stop	chan struct{}	// 关闭后台的过期清理
+	once	sync.Once
+	store	*fileStore		// 持久化存储，为nil时不持久化
+	tombstones	map[string]time.Time	// 已注销的服务及注销时间，用于集群间合并状态
+	cluster	*cluster		// 集群中的其他节点，为nil时不复制
+	rules	[]byte			// 路由规则，JSON数组
+	logger	myrpc.LoggerHolder	// 日志，见 SetLogger
 }
 
 type ServerItem struct {
 	Addr string
 	start time.Time
+	unconfirmed bool // 从磁盘恢复后还没有收到过心跳
 }
 
 const (
 	defaultPath = "/myrpc/registry"
 	defaultTimeout = time.Minute * 5
+	defaultSweepInterval = time.Minute
 )
 
 // 创造一个MyResigter实例
 func New(timeout time.Duration) *MyRegistry {
 	return &MyRegistry{
 		servers: make(map[string]*ServerItem),
+		tombstones: make(map[string]time.Time),
 		timeout: timeout,
+		events: newEventLog(defaultEventLogSize),
+		stop: make(chan struct{}),
 	}
 }
 
 var DefaultMyRegister = New(defaultTimeout)
 
-// 添加服务实例
-func (r *MyRegistry) putServer(addr string) {
+// SetLogger 设置注册中心的日志，为 nil 时使用 myrpc.DefaultLogger
+func (r *MyRegistry) SetLogger(l myrpc.Logger) {
+	r.logger.Store(l)
+}
+
+// 添加服务实例，返回该服务之前是否不存在
+func (r *MyRegistry) putServer(addr string) bool {
+	return r.putServerAt(addr, time.Now(), false)
+}
+
+// 在时间t添加服务实例。replicated表示来自集群中的其他节点，
+// 此时只接受比本地更新的心跳，并且不再转发
+func (r *MyRegistry) putServerAt(addr string, t time.Time, replicated bool) bool {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	server := r.servers[addr]
+	if replicated {
+		if server != nil && !t.After(server.start) {
+			r.mu.Unlock()
+			return false
+		}
+		if deleted, ok := r.tombstones[addr]; ok && !t.After(deleted) {
+			r.mu.Unlock()
+			return false
+		}
+	}
+	delete(r.tombstones, addr)
+	event := Event{Type: EventRenewed, Addr: addr, Time: t}
+	refresh := server != nil && !server.unconfirmed
 	if server == nil {
 		// 若服务不存在，创建一个新的实例
 		r.servers[addr] = &ServerItem{
 			Addr: addr,
-			start: time.Now(),
+			start: event.Time,
 		}
+		event.Type = EventRegistered
 	} else {
 		// 若已经存在，更新时间
-		server.start = time.Now()
+		server.start = event.Time
+		server.unconfirmed = false
+	}
+	r.persistLocked(opPut, addr, event.Time, refresh)
+	notify := r.events.add(event)
+	r.mu.Unlock()
+	notify()
+	if !replicated {
+		r.replicate(storeRecord{Op: opPut, Addr: addr, Time: t})
+	}
+	return event.Type == EventRegistered
+}
+
+// 注销服务实例，服务不存在时返回false
+func (r *MyRegistry) removeServer(addr string) bool {
+	return r.removeServerAt(addr, time.Now(), false)
+}
+
+// 在时间t注销服务实例。若服务在t之后还发送过心跳，则不会被删除
+func (r *MyRegistry) removeServerAt(addr string, t time.Time, replicated bool) bool {
+	r.mu.Lock()
+	server, ok := r.servers[addr]
+	if ok && server.start.After(t) {
+		r.mu.Unlock()
+		return false
 	}
+	if deleted, found := r.tombstones[addr]; !found || t.After(deleted) {
+		r.tombstones[addr] = t
+	}
+	delete(r.servers, addr)
+	notify := func() {}
+	if ok {
+		r.persistLocked(opDel, addr, t, false)
+		notify = r.events.add(Event{Type: EventDeregistered, Addr: addr, Time: t})
+	}
+	r.mu.Unlock()
+	notify()
+	if !replicated {
+		r.replicate(storeRecord{Op: opDel, Addr: addr, Time: t})
+	}
+	return ok
 }
 
 // 获取所有可用的服务
 func (r *MyRegistry) aliveServers() []string {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	var alive []string
+	notify := r.events.add(r.expireLocked(time.Now())...)
+	for addr := range r.servers {
+		alive = append(alive, addr)
+	}
+	r.mu.Unlock()
+	notify()
+	sort.Strings(alive)
+	return alive
+}
+
+// 删除所有过期的服务，返回对应的事件。调用时需要持有r.mu
+func (r *MyRegistry) expireLocked(now time.Time) []Event {
+	// 注销记录保留一个过期时间，足够集群中的其他节点完成合并
+	for addr, deleted := range r.tombstones {
+		if !deleted.Add(r.tombstoneTTL()).After(now) {
+			delete(r.tombstones, addr)
+		}
+	}
+	if r.timeout == 0 {
+		return nil
+	}
+	var expired []Event
 	for addr, server := range r.servers {
-		if r.timeout == 0 || server.start.Add(r.timeout).After(time.Now()) {
-			// 若服务没有过期，添加到alive
-			alive = append(alive, addr)
-		} else {
-			// 若已经过期，删除该服务
+		if !server.start.Add(r.timeout).After(now) {
 			delete(r.servers, addr)
+			r.persistLocked(opDel, addr, now, false)
+			expired = append(expired, Event{Type: EventExpired, Addr: addr, Time: now})
 		}
 	}
-	sort.Strings(alive)
-	return alive
+	return expired
+}
+
+// 从磁盘恢复后还没有收到心跳的服务
+func (r *MyRegistry) unconfirmedServers() []string {
+	r.mu.Lock()
+	var servers []string
+	for addr, server := range r.servers {
+		if server.unconfirmed {
+			servers = append(servers, addr)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(servers)
+	return servers
+}
+
+// EnablePersistence 把注册中心的状态保存在目录dir中，并恢复dir中已有的状态。
+// 恢复出的服务被标记为未确认，直到它们再次发送心跳；已经过期的服务会被丢弃。
+// 需要在注册中心开始提供服务之前调用
+func (r *MyRegistry) EnablePersistence(dir string) error {
+	// 已知服务的心跳每半个过期时间最多写入一次
+	refresh := r.tombstoneTTL() / 2
+	store, servers, err := openStore(dir, refresh, &r.logger)
+	if err != nil {
+		return err
+	}
+	rules, err := readRules(dir)
+	if err != nil {
+		_ = store.Close()
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store != nil {
+		_ = store.Close()
+		return errors.New("rpc registry: persistence already enabled")
+	}
+	r.store = store
+	if rules != nil {
+		r.rules = rules
+	}
+	for addr, start := range servers {
+		if _, ok := r.servers[addr]; ok {
+			continue
+		}
+		r.servers[addr] = &ServerItem{Addr: addr, start: start, unconfirmed: true}
+	}
+	r.expireLocked(time.Now())
+	// 用恢复后的状态写一份快照，日志从空开始
+	if err = r.store.writeSnapshot(r.snapshotLocked()); err != nil {
+		r.logger.Errorf("rpc registry: write snapshot err: %v", err)
+	}
+	r.logger.Infof("rpc registry: restored %d servers from %s", len(r.servers), dir)
+	return nil
+}
+
+// 记录一次变化，由存储在后台写入磁盘，不会阻塞。refresh 表示已知服务的心跳。调用时需要持有r.mu
+func (r *MyRegistry) persistLocked(op, addr string, t time.Time, refresh bool) {
+	if r.store == nil {
+		return
+	}
+	r.store.append(storeRecord{Op: op, Addr: addr, Time: t, refresh: refresh})
+}
+
+// 当前所有服务最后一次心跳的时间，调用时需要持有r.mu
+func (r *MyRegistry) snapshotLocked() map[string]time.Time {
+	servers := make(map[string]time.Time, len(r.servers))
+	for addr, server := range r.servers {
+		servers[addr] = server.start
+	}
+	return servers
+}
+
+// sweep 清理一次过期的服务
+func (r *MyRegistry) sweep() {
+	r.mu.Lock()
+	notify := r.events.add(r.expireLocked(time.Now())...)
+	r.mu.Unlock()
+	notify()
+}
+
+// StartSweeper 开始一个go程，每隔interval清理一次过期的服务，interval为0时使用默认值。
+// 否则过期的服务只会在获取服务列表时被删除
+func (r *MyRegistry) StartSweeper(interval time.Duration) {
+	if interval == 0 {
+		interval = defaultSweepInterval
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-t.C:
+				r.sweep()
+			}
+		}
+	}()
+}
+
+// Close 停止后台的清理，并关闭持久化存储
+func (r *MyRegistry) Close() error {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+	r.mu.Lock()
+	store := r.store
+	r.store = nil
+	r.mu.Unlock()
+	if store == nil {
+		return nil
+	}
+	// 在 r.mu 之外等待剩下的记录写入
+	return store.Close()
+}
+
+// Subscribe 订阅注册中心的事件，返回取消订阅的函数。
+// hook 在产生事件的go程中被同步调用，不应阻塞
+func (r *MyRegistry) Subscribe(hook func(Event)) (unsubscribe func()) {
+	return r.events.subscribe(hook)
+}
+
+// Events 返回序号大于since的事件，最多limit条
+func (r *MyRegistry) Events(since uint64, limit int) []Event {
+	return r.events.since(since, limit)
+}
+
+func (r *MyRegistry) tombstoneTTL() time.Duration {
+	if r.timeout == 0 {
+		return defaultTimeout
+	}
+	return r.timeout
 }
 
 func (r *MyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/events") {
+		r.serveEvents(w, req)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/state") {
+		r.serveState(w, req)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/rules") {
+		r.serveRules(w, req)
+		return
+	}
+	if req.Header.Get("X-Myrpc-Replica") != "" {
+		r.serveReplica(w, req)
+		return
+	}
 	switch req.Method {
 	case "GET":
 		w.Header().Set("X-Myrpc-Servers", strings.Join(r.aliveServers(), ","))
+		if unconfirmed := r.unconfirmedServers(); len(unconfirmed) > 0 {
+			w.Header().Set("X-Myrpc-Unconfirmed", strings.Join(unconfirmed, ","))
+		}
 	case "POST":
 		addr := req.Header.Get("X-Myrpc-Server")
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		_ = r.putServer(addr)
+	case "DELETE":
+		addr := req.Header.Get("X-Myrpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !r.removeServer(addr) {
+			w.WriteHeader(http.StatusNotFound)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// serveEvents 以JSON的形式返回事件，支持 ?since=序号&limit=数量
+func (r *MyRegistry) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var since uint64
+	var limit int
+	var err error
+	query := req.URL.Query()
+	if v := query.Get("since"); v != "" {
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid since: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(r.Events(since, limit))
+}
+
 func (r *MyRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
-	log.Println("rpc registry path:", registryPath)
+	http.Handle(registryPath+"/events", r)
+	http.Handle(registryPath+"/state", r)
+	http.Handle(registryPath+"/rules", r)
+	r.logger.Infof("rpc registry path: %s", registryPath)
 }
 
+// HandleHTTP 在默认路径上提供默认注册中心的服务，并在后台清理过期的服务
 func HandleHTTP() {
 	DefaultMyRegister.HandleHTTP(defaultPath)
+	DefaultMyRegister.StartSweeper(0)
+}
+
+// HeartbeatOption 心跳的相关配置
+type HeartbeatOption struct {
+	Duration         time.Duration                       // 正常情况下发送心跳的间隔
+	MinBackoff       time.Duration                       // 失败后第一次重试前的等待时间
+	MaxBackoff       time.Duration                       // 重试等待时间的上限，默认为 Duration
+	FailureThreshold int                                 // 连续失败多少次视为持续失败
+	OnFailure        func(status myrpc.HeartbeatStatus) // 持续失败时的回调，每一轮连续失败只调用一次
+	Logger           myrpc.Logger                        // 心跳的日志，第一次心跳就会使用，之后可以通过 SetLogger 替换
+}
+
+const (
+	defaultMinBackoff       = time.Second
+	defaultFailureThreshold = 3
+)
+
+// Heartbeater 定时向注册中心发送心跳。发送失败时以指数退避的方式重试，
+// 注册中心恢复后（例如重启）下一次成功的心跳即完成重新注册。
+// 有多个注册中心时，一个不可用会依次尝试下一个
+type Heartbeater struct {
+	registries []string
+	current    int // 最近一次成功的注册中心
+	addr       string
+	opt      HeartbeatOption
+	mu       sync.Mutex // protect status
+	status   myrpc.HeartbeatStatus
+	stop     chan struct{}
+	done     chan struct{} // 发送心跳的go程退出时关闭
+	once     sync.Once
+	logger   myrpc.LoggerHolder // 日志，默认为 HeartbeatOption.Logger，见 SetLogger
+}
+
+var _ myrpc.HeartbeatReporter = (*Heartbeater)(nil)
+
+// Heartbeat 每隔 duration 向注册中心发送一次心跳，duration 为 0 时使用默认值
+func Heartbeat(registry, addr string, duration time.Duration) *Heartbeater {
+	return StartHeartbeat(registry, addr, &HeartbeatOption{Duration: duration})
+}
+
+// StartHeartbeat 根据 opt 开始发送心跳。第一次心跳是同步发送的
+func StartHeartbeat(registry, addr string, opt *HeartbeatOption) *Heartbeater {
+	h, _ := HeartbeatCluster([]string{registry}, addr, opt)
+	return h
+}
+
+var errNoRegistry = errors.New("rpc registry: no registry to send heartbeats to")
+
+// HeartbeatCluster 向注册中心集群发送心跳，每次只发送给其中一个，由集群负责复制。
+// registries 为空时返回错误
+func HeartbeatCluster(registries []string, addr string, opt *HeartbeatOption) (*Heartbeater, error) {
+	if len(registries) == 0 {
+		return nil, errNoRegistry
+	}
+	h := &Heartbeater{
+		registries: registries,
+		addr:       addr,
+		opt:        parseHeartbeatOption(opt),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	h.logger.Store(h.opt.Logger)
+	h.status.Registry = registries[0]
+	h.status.Addr = addr
+	h.beat()
+	go h.run()
+	return h, nil
+}
+
+func parseHeartbeatOption(opt *HeartbeatOption) HeartbeatOption {
+	var o HeartbeatOption
+	if opt != nil {
+		o = *opt
+	}
+	if o.Duration == 0 {
+		o.Duration = defaultTimeout - time.Duration(1)*time.Minute
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = defaultMinBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = o.Duration
+	}
+	if o.MinBackoff > o.MaxBackoff {
+		o.MinBackoff = o.MaxBackoff
+	}
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = defaultFailureThreshold
+	}
+	return o
+}
+
+// SetLogger 设置心跳的日志，为 nil 时使用 myrpc.DefaultLogger
+func (h *Heartbeater) SetLogger(l myrpc.Logger) {
+	h.logger.Store(l)
+}
+
+// HeartbeatStatus 返回当前的心跳状态，用于调试页面
+func (h *Heartbeater) HeartbeatStatus() myrpc.HeartbeatStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
 }
 
-func Heartbeat(registry, addr string, duration time.Duration) {
-	if duration == 0 {
-		duration = defaultTimeout - time.Duration(1) * time.Minute
+// Stop 停止发送心跳，等待正在发送的心跳结束后返回，因此不能在 OnFailure 中调用
+func (h *Heartbeater) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+}
+
+// Deregister 停止发送心跳，并从注册中心注销服务。
+// 从最近一次成功的注册中心开始，失败时依次尝试其他注册中心
+func (h *Heartbeater) Deregister() error {
+	h.Stop()
+	h.mu.Lock()
+	start := h.current
+	h.mu.Unlock()
+	var err error
+	for i := 0; i < len(h.registries); i++ {
+		if err = h.sendDeregister(h.registries[(start+i)%len(h.registries)]); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h *Heartbeater) run() {
+	defer close(h.done)
+	for {
+		h.mu.Lock()
+		failures := h.status.ConsecutiveFailures
+		h.mu.Unlock()
+		wait := h.opt.Duration
+		if failures > 0 {
+			wait = myrpc.Backoff(h.opt.MinBackoff, h.opt.MaxBackoff, failures)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-h.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		h.beat()
 	}
+}
+
+// 发送一次心跳并更新状态。从上次成功的注册中心开始，依次尝试所有注册中心
+func (h *Heartbeater) beat() {
+	h.mu.Lock()
+	start := h.current
+	h.mu.Unlock()
 	var err error
-	err = sendHeartbeat(registry, addr)
-	go func() {
-		// 开始一个go程，每过一段时间发送一次心跳
-		t := time.NewTicker(duration)
-		// 若未出错继续发送
-		for err == nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
+	var registry string
+	for i := 0; i < len(h.registries); i++ {
+		registry = h.registries[(start+i)%len(h.registries)]
+		if err = h.sendHeartbeat(registry); err == nil {
+			h.mu.Lock()
+			h.current = (start + i) % len(h.registries)
+			h.mu.Unlock()
+			break
 		}
-	}()
+	}
+	h.mu.Lock()
+	if err == nil {
+		if h.status.ConsecutiveFailures > 0 {
+			h.logger.Infof("rpc server: %s registered to %s again after %d failures", h.addr, registry, h.status.ConsecutiveFailures)
+		}
+		h.status.Registry = registry
+		h.status.LastSuccess = time.Now()
+		h.status.LastError = ""
+		h.status.ConsecutiveFailures = 0
+		h.mu.Unlock()
+		return
+	}
+	h.status.LastError = err.Error()
+	h.status.ConsecutiveFailures++
+	status := h.status
+	h.mu.Unlock()
+	// 达到阈值时回调，之后直到恢复前不再重复回调
+	if status.ConsecutiveFailures == h.opt.FailureThreshold && h.opt.OnFailure != nil {
+		h.opt.OnFailure(status)
+	}
 }
 
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
+// 心跳请求的超时时间，避免注册中心无响应时心跳永远阻塞
+const heartbeatRequestTimeout = time.Second * 10
+
+var registryClient = &http.Client{Timeout: heartbeatRequestTimeout}
+
+func (h *Heartbeater) sendHeartbeat(registry string) error {
+	h.logger.Debugf("%s send heart beat to registry %s", h.addr, registry)
+	if err := sendRegistryRequest("POST", registry, h.addr); err != nil {
+		h.logger.Warnf("rpc server: heart beat err: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (h *Heartbeater) sendDeregister(registry string) error {
+	h.logger.Infof("%s deregister from registry %s", h.addr, registry)
+	err := sendRegistryRequest("DELETE", registry, h.addr)
+	if err != nil {
+		h.logger.Warnf("rpc server: deregister err: %v", err)
+	}
+	return err
+}
+
+func sendRegistryRequest(method, registry, addr string) error {
+	req, _ := http.NewRequest(method, registry, nil)
 	req.Header.Set("X-Myrpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heart beat err:", err)
+	resp, err := registryClient.Do(req)
+	if err != nil {
 		return err
 	}
+	// 读完并关闭 body，连接才能被复用
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
 	return nil
 }
@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"MyRpc/07_registry/myrpc"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestHeartbeat_Deregister(t *testing.T) {
+	r := New(time.Minute)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// 心跳到达得比较慢，注销时可能还有心跳在路上
+		if req.Method == "POST" {
+			time.Sleep(time.Millisecond * 30)
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	h := StartHeartbeat(ts.URL, "tcp@server", &HeartbeatOption{Duration: time.Millisecond * 10})
+	time.Sleep(time.Millisecond * 20)
+	_assert(h.Deregister() == nil, "failed to deregister")
+	time.Sleep(time.Millisecond * 100)
+	_assert(len(r.aliveServers()) == 0, "expect no heartbeat after deregister, got %v", r.aliveServers())
+
+	// 最近使用的注册中心拒绝注销时，向下一个注册中心注销
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "DELETE" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer first.Close()
+	r.putServer("tcp@server")
+	h, err := HeartbeatCluster([]string{first.URL, ts.URL}, "tcp@server", &HeartbeatOption{Duration: time.Hour})
+	_assert(err == nil && h.HeartbeatStatus().Registry == first.URL, "expect heartbeats to the first registry")
+	_assert(h.Deregister() == nil, "expect deregister to fall back to the next registry")
+	_assert(len(r.aliveServers()) == 0, "expect the server deregistered from the next registry")
+}
+
+func TestHeartbeat_Retry(t *testing.T) {
+	r := New(time.Minute)
+	var fails int32 = 3
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// 模拟注册中心短暂不可用
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	var failed int32
+	h := StartHeartbeat(ts.URL, "tcp@server", &HeartbeatOption{
+		Duration:         time.Hour,
+		MinBackoff:       time.Millisecond * 10,
+		MaxBackoff:       time.Millisecond * 20,
+		FailureThreshold: 2,
+		OnFailure: func(status myrpc.HeartbeatStatus) {
+			atomic.AddInt32(&failed, 1)
+		},
+	})
+	defer h.Stop()
+	status := h.HeartbeatStatus()
+	_assert(status.ConsecutiveFailures == 1 && status.LastError != "", "expect first heartbeat to fail, got %+v", status)
+
+	deadline := time.Now().Add(time.Second * 2)
+	for len(r.aliveServers()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	status = h.HeartbeatStatus()
+	_assert(len(r.aliveServers()) == 1, "expect server registered after retries")
+	_assert(status.ConsecutiveFailures == 0 && !status.LastSuccess.IsZero(), "expect status reset, got %+v", status)
+	_assert(atomic.LoadInt32(&failed) == 1, "expect OnFailure called once, got %d", failed)
+}
+
+func TestMyRegistry_Sweeper(t *testing.T) {
+	r := New(time.Millisecond * 50)
+	defer r.Close()
+	var expired int32
+	unsubscribe := r.Subscribe(func(e Event) {
+		if e.Type == EventExpired {
+			atomic.AddInt32(&expired, 1)
+		}
+	})
+	defer unsubscribe()
+	r.putServer("tcp@a")
+	r.putServer("tcp@b")
+	r.putServer("tcp@b")
+	_ = r.removeServer("tcp@b")
+	r.StartSweeper(time.Millisecond * 10)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&expired) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(atomic.LoadInt32(&expired) == 1, "expect tcp@a expired by the sweeper")
+
+	var types []EventType
+	for _, e := range r.Events(0, 0) {
+		types = append(types, e.Type)
+	}
+	want := []EventType{EventRegistered, EventRegistered, EventRenewed, EventDeregistered, EventExpired}
+	_assert(fmt.Sprint(types) == fmt.Sprint(want), "expect events %v, got %v", want, types)
+	_assert(len(r.Events(4, 0)) == 1 && len(r.Events(0, 2)) == 2, "wrong since/limit filtering")
+}
+
+func TestEventLog_Overflow(t *testing.T) {
+	l := newEventLog(3)
+	for i := 0; i < 5; i++ {
+		l.append(Event{Type: EventRenewed, Addr: "tcp@a"})
+	}
+	events := l.since(0, 0)
+	_assert(len(events) == 3 && events[0].Seq == 3 && events[2].Seq == 5, "expect the last 3 events, got %v", events)
+}
+
+func TestMyRegistry_EventOrder(t *testing.T) {
+	r := New(0)
+	defer r.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if (i+j)%2 == 0 {
+					r.putServer("tcp@a")
+				} else {
+					_ = r.removeServer("tcp@a")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 按序号重放事件得到的状态应与注册中心一致
+	alive := false
+	for _, e := range r.Events(0, 0) {
+		alive = e.Type == EventRegistered || e.Type == EventRenewed
+	}
+	_assert(alive == (len(r.aliveServers()) == 1), "replayed state differs from registry")
+}
@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"MyRpc/07_registry/myrpc"
+	"errors"
+	"time"
+)
+
+// Registry 以 MyRPC 服务的形式提供注册中心，与 HTTP 共享同一个 MyRegistry 的状态，
+// 因此两种方式可以同时使用：
+//
+//	server.Register(registry.NewRegistryService(r))
+//	r.HandleHTTP(path)
+type Registry struct {
+	r *MyRegistry
+}
+
+// NewRegistryService 返回基于 r 的注册中心服务
+func NewRegistryService(r *MyRegistry) *Registry {
+	return &Registry{r: r}
+}
+
+// HandleRPC 在 server 上注册基于 r 的注册中心服务
+func (r *MyRegistry) HandleRPC(server *myrpc.Server) error {
+	return server.Register(NewRegistryService(r))
+}
+
+// ServerArgs 是 Register、Heartbeat 和 Deregister 的参数
+type ServerArgs struct {
+	Addr string // 服务地址，格式为 protocol@addr
+}
+
+// ListArgs 是 List 的参数，目前没有可选项
+type ListArgs struct{}
+
+// WatchArgs 是 Watch 的参数
+type WatchArgs struct {
+	Version uint64        // 调用方已知的版本
+	Timeout time.Duration // 最长等待时间，为0时使用默认值
+}
+
+// ListReply 是 List 和 Watch 的返回值
+type ListReply struct {
+	Servers     []string // 所有可用的服务
+	Unconfirmed []string // 从磁盘恢复后还没有收到心跳的服务
+	Version     uint64   // 服务列表的版本
+}
+
+const (
+	defaultWatchTimeout = time.Second * 30
+	maxWatchTimeout     = time.Minute * 5
+)
+
+var errEmptyAddr = errors.New("rpc registry: empty server address")
+
+// Register 注册一个服务，reply 表示该服务之前是否不存在
+func (s *Registry) Register(args ServerArgs, reply *bool) error {
+	if args.Addr == "" {
+		return errEmptyAddr
+	}
+	*reply = s.r.putServer(args.Addr)
+	return nil
+}
+
+// Heartbeat 续约一个服务。服务不存在时（如注册中心重启后）会重新注册，
+// 此时 reply 为 false
+func (s *Registry) Heartbeat(args ServerArgs, reply *bool) error {
+	if args.Addr == "" {
+		return errEmptyAddr
+	}
+	*reply = !s.r.putServer(args.Addr)
+	return nil
+}
+
+// Deregister 注销一个服务，reply 表示该服务之前是否存在
+func (s *Registry) Deregister(args ServerArgs, reply *bool) error {
+	if args.Addr == "" {
+		return errEmptyAddr
+	}
+	*reply = s.r.removeServer(args.Addr)
+	return nil
+}
+
+// List 返回当前所有可用的服务
+func (s *Registry) List(args ListArgs, reply *ListReply) error {
+	s.list(reply)
+	return nil
+}
+
+// Watch 等待服务列表的版本超过 args.Version 后返回新的列表，
+// 超时后返回当前的列表，调用方通过 Version 判断是否有变化
+func (s *Registry) Watch(args WatchArgs, reply *ListReply) error {
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = defaultWatchTimeout
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+wait:
+	for {
+		version, changed := s.r.events.membership()
+		if version != args.Version {
+			break
+		}
+		select {
+		case <-changed:
+		case <-t.C:
+			break wait
+		}
+	}
+	s.list(reply)
+	return nil
+}
+
+func (s *Registry) list(reply *ListReply) {
+	// 先取版本再取列表，列表至少和版本一样新
+	reply.Version, _ = s.r.events.membership()
+	reply.Servers = s.r.aliveServers()
+	reply.Unconfirmed = s.r.unconfirmedServers()
+}
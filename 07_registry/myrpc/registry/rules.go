@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// 注册中心原样保存和返回路由规则，规则的含义由客户端解释，见 xclient.Rule
+
+const (
+	rulesFile    = "rules.json"
+	maxRulesSize = 1 << 20
+)
+
+var errInvalidRules = errors.New("rpc registry: rules must be a JSON array")
+
+// SetRules 设置路由规则，data 需要是一个 JSON 数组。启用了持久化时同时写入磁盘
+func (r *MyRegistry) SetRules(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) || len(data) == 0 || data[0] != '[' {
+		return errInvalidRules
+	}
+	rules := make([]byte, len(data))
+	copy(rules, data)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+	if r.store != nil {
+		if err := r.store.writeRules(rules); err != nil {
+			r.logger.Errorf("rpc registry: write rules err: %v", err)
+		}
+	}
+	return nil
+}
+
+// Rules 返回当前的路由规则，没有设置时为空数组
+func (r *MyRegistry) Rules() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rules == nil {
+		return []byte("[]")
+	}
+	return r.rules
+}
+
+// serveRules GET 返回路由规则，PUT 或 POST 以请求体替换路由规则
+func (r *MyRegistry) serveRules(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(r.Rules())
+	case "PUT", "POST":
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRulesSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = r.SetRules(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeRules 把路由规则写入磁盘
+func (s *fileStore) writeRules(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := filepath.Join(s.dir, rulesFile+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, rulesFile)); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+	return nil
+}
+
+// readRules 读取 dir 中的路由规则，文件不存在时返回 nil
+func readRules(dir string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, rulesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
@@ -0,0 +1,323 @@
+package registry
+
+import (
+	"MyRpc/07_registry/myrpc"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFile = "registry.snapshot"
+	logFile      = "registry.log"
+	// 日志超过这么多条后，写一次快照并清空日志
+	defaultCompactThreshold = 4096
+)
+
+const (
+	opPut = "put"
+	opDel = "del"
+)
+
+// storeRecord 是追加日志中的一条记录，每条记录占一行
+type storeRecord struct {
+	Op      string    `json:"op"`
+	Addr    string    `json:"addr"`
+	Time    time.Time `json:"time"`
+	refresh bool      // 已知服务的心跳，只更新时间
+}
+
+// storeSnapshot 是某一时刻所有服务的快照
+type storeSnapshot struct {
+	Servers []storeRecord `json:"servers"`
+}
+
+// fileStore 把注册中心的状态保存在目录中：快照 + 快照之后的追加日志。
+// 快照先写入临时文件再重命名，因此崩溃后要么是旧快照，要么是新快照；
+// 日志末尾因崩溃而写了一半的记录会在恢复时被截断。
+// 记录由后台的go程成批写入，每批只刷一次磁盘，提交记录时不会等待磁盘
+type fileStore struct {
+	dir     string
+	refresh time.Duration       // 已知服务的心跳距离上次写入不到 refresh 时不写入，恢复后服务本来就是未确认的
+	logger  *myrpc.LoggerHolder // 写入失败时的日志
+	mu      sync.Mutex          // protect following，写入磁盘时持有
+	log     *os.File
+	entries int                  // 日志中的记录数
+	compact int                  // 日志记录数超过 compact 后压缩
+	state   map[string]time.Time // 已经写入的服务，压缩时写成快照
+	pmu     sync.Mutex           // protect following
+	pending []storeRecord        // 等待写入的记录
+	flushed []chan struct{}      // pending 写入后关闭
+	closed  bool
+	wake    chan struct{} // 有新的记录时通知写入的go程
+	done    chan struct{} // 写入的go程退出时关闭
+}
+
+// openStore 打开 dir 中的状态，返回 store 和恢复出的服务（以地址为键，值为最后一次心跳的时间）
+func openStore(dir string, refresh time.Duration, logger *myrpc.LoggerHolder) (*fileStore, map[string]time.Time, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	servers, err := readSnapshot(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := replayLog(f, servers)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	s := &fileStore{
+		dir:     dir,
+		refresh: refresh,
+		logger:  logger,
+		log:     f,
+		entries: entries,
+		compact: defaultCompactThreshold,
+		state:   make(map[string]time.Time),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, servers, nil
+}
+
+func readSnapshot(path string) (map[string]time.Time, error) {
+	servers := make(map[string]time.Time)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return servers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot storeSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("rpc registry: corrupt snapshot %s: %v", path, err)
+	}
+	for _, record := range snapshot.Servers {
+		servers[record.Addr] = record.Time
+	}
+	return servers, nil
+}
+
+// replayLog 把日志中的记录应用到 servers 上。遇到不完整或损坏的记录时，
+// 认为它是崩溃时写了一半的，把日志截断到最后一条完整的记录
+func replayLog(f *os.File, servers map[string]time.Time) (int, error) {
+	reader := bufio.NewReader(f)
+	var offset int64
+	entries := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// 最后一行没有换行符，说明写入没有完成
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		var record storeRecord
+		if json.Unmarshal(bytes.TrimSpace(line), &record) != nil {
+			break
+		}
+		switch record.Op {
+		case opPut:
+			servers[record.Addr] = record.Time
+		case opDel:
+			delete(servers, record.Addr)
+		}
+		offset += int64(len(line))
+		entries++
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return entries, nil
+}
+
+// append 提交一条记录，由后台的go程写入，不会阻塞
+func (s *fileStore) append(record storeRecord) {
+	s.pmu.Lock()
+	if s.closed {
+		s.pmu.Unlock()
+		return
+	}
+	s.pending = append(s.pending, record)
+	s.pmu.Unlock()
+	s.notify()
+}
+
+func (s *fileStore) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush 等待已经提交的记录写入磁盘
+func (s *fileStore) flush() {
+	ch := make(chan struct{})
+	s.pmu.Lock()
+	if s.closed {
+		s.pmu.Unlock()
+		return
+	}
+	s.flushed = append(s.flushed, ch)
+	s.pmu.Unlock()
+	s.notify()
+	<-ch
+}
+
+// run 每次取出所有等待写入的记录一起写入，关闭后写完剩下的记录再退出
+func (s *fileStore) run() {
+	defer close(s.done)
+	for range s.wake {
+		s.pmu.Lock()
+		records, flushed, closed := s.pending, s.flushed, s.closed
+		s.pending, s.flushed = nil, nil
+		s.pmu.Unlock()
+		if err := s.write(records); err != nil {
+			s.logger.Errorf("rpc registry: persist err: %v", err)
+		}
+		for _, ch := range flushed {
+			close(ch)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// write 追加一批记录并刷到磁盘，日志足够长时写快照
+func (s *fileStore) write(records []storeRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	n := 0
+	for _, record := range records {
+		switch record.Op {
+		case opPut:
+			if last, ok := s.state[record.Addr]; ok && record.refresh && record.Time.Sub(last) < s.refresh {
+				continue
+			}
+			s.state[record.Addr] = record.Time
+		case opDel:
+			delete(s.state, record.Addr)
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.entries += n
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	if s.entries >= s.compact {
+		return s.snapshotLocked()
+	}
+	return nil
+}
+
+// writeSnapshot 把 servers 写成新的快照并清空日志
+func (s *fileStore) writeSnapshot(servers map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = make(map[string]time.Time, len(servers))
+	for addr, t := range servers {
+		s.state[addr] = t
+	}
+	return s.snapshotLocked()
+}
+
+// snapshotLocked 把 s.state 写成新的快照并清空日志。调用时需要持有s.mu
+func (s *fileStore) snapshotLocked() error {
+	snapshot := storeSnapshot{Servers: make([]storeRecord, 0, len(s.state))}
+	for addr, t := range s.state {
+		snapshot.Servers = append(snapshot.Servers, storeRecord{Op: opPut, Addr: addr, Time: t})
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	if err = writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+	// 快照已经包含了日志中的所有记录，可以清空日志
+	if err = s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.entries = 0
+	return s.log.Sync()
+}
+
+// Close 写完已经提交的记录后关闭日志，之后提交的记录被丢弃
+func (s *fileStore) Close() error {
+	s.pmu.Lock()
+	if s.closed {
+		s.pmu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.pmu.Unlock()
+	s.notify()
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir 把目录项的变化（如重命名）刷到磁盘，部分系统不支持，忽略错误
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
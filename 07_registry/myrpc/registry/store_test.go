@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMyRegistry_Restore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "myrpc-registry")
+	defer os.RemoveAll(dir)
+
+	r := New(time.Minute)
+	_assert(r.EnablePersistence(dir) == nil, "failed to enable persistence")
+	r.putServer("tcp@a")
+	r.putServer("tcp@b")
+	r.putServer("tcp@c")
+	_ = r.removeServer("tcp@c")
+	// 等待后台写入磁盘后不调用 Close，模拟注册中心崩溃
+	r.store.flush()
+
+	r2 := New(time.Minute)
+	_assert(r2.EnablePersistence(dir) == nil, "failed to restore")
+	defer r2.Close()
+	alive := fmt.Sprint(r2.aliveServers())
+	_assert(alive == "[tcp@a tcp@b]", "expect [tcp@a tcp@b] restored, got %s", alive)
+	unconfirmed := fmt.Sprint(r2.unconfirmedServers())
+	_assert(unconfirmed == "[tcp@a tcp@b]", "expect restored servers unconfirmed, got %s", unconfirmed)
+	r2.putServer("tcp@a")
+	unconfirmed = fmt.Sprint(r2.unconfirmedServers())
+	_assert(unconfirmed == "[tcp@b]", "expect tcp@a confirmed by heartbeat, got %s", unconfirmed)
+}
+
+func TestMyRegistry_RestoreTornWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "myrpc-registry")
+	defer os.RemoveAll(dir)
+
+	r := New(time.Minute)
+	_assert(r.EnablePersistence(dir) == nil, "failed to enable persistence")
+	r.putServer("tcp@a")
+	_ = r.Close()
+	// 模拟崩溃时写了一半的记录，以及没来得及重命名的临时快照
+	f, _ := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"op":"put","addr":"tcp@b","ti`)
+	_ = f.Close()
+	_ = ioutil.WriteFile(filepath.Join(dir, snapshotFile+".tmp"), []byte("{garbage"), 0644)
+
+	r2 := New(time.Minute)
+	_assert(r2.EnablePersistence(dir) == nil, "failed to restore after torn write")
+	r2.putServer("tcp@c")
+	_ = r2.Close()
+
+	r3 := New(time.Minute)
+	_assert(r3.EnablePersistence(dir) == nil, "failed to restore")
+	defer r3.Close()
+	alive := fmt.Sprint(r3.aliveServers())
+	_assert(alive == "[tcp@a tcp@c]", "expect [tcp@a tcp@c], got %s", alive)
+}
+
+func TestMyRegistry_RestoreExpired(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "myrpc-registry")
+	defer os.RemoveAll(dir)
+
+	r := New(time.Millisecond * 50)
+	_assert(r.EnablePersistence(dir) == nil, "failed to enable persistence")
+	r.putServer("tcp@a")
+	_ = r.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	r2 := New(time.Millisecond * 50)
+	_assert(r2.EnablePersistence(dir) == nil, "failed to restore")
+	defer r2.Close()
+	_assert(len(r2.aliveServers()) == 0, "expect expired server dropped on restore")
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "myrpc-registry")
+	defer os.RemoveAll(dir)
+
+	r := New(time.Minute)
+	_assert(r.EnablePersistence(dir) == nil, "failed to enable persistence")
+	r.store.mu.Lock()
+	r.store.compact = 10
+	r.store.mu.Unlock()
+	for i := 0; i < 25; i++ {
+		r.putServer(fmt.Sprintf("tcp@%d", i))
+	}
+	r.store.flush()
+	r.store.mu.Lock()
+	_assert(r.store.entries < 10, "expect log compacted, got %d entries", r.store.entries)
+	r.store.mu.Unlock()
+	_ = r.Close()
+
+	r2 := New(time.Minute)
+	_assert(r2.EnablePersistence(dir) == nil, "failed to restore")
+	defer r2.Close()
+	_assert(len(r2.aliveServers()) == 25, "expect 25 servers after compaction, got %v", r2.aliveServers())
+}
+
+func TestFileStore_SkipRefresh(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "myrpc-registry")
+	defer os.RemoveAll(dir)
+
+	r := New(time.Minute)
+	_assert(r.EnablePersistence(dir) == nil, "failed to enable persistence")
+	defer r.Close()
+	// 已知服务的心跳不会每次都写入日志
+	for i := 0; i < 10; i++ {
+		r.putServer("tcp@a")
+	}
+	r.store.flush()
+	r.store.mu.Lock()
+	entries := r.store.entries
+	r.store.mu.Unlock()
+	_assert(entries == 1, "expect refresh-only heartbeats to be skipped, got %d entries", entries)
+
+	// 写入磁盘时不持有 r.mu
+	r.store.mu.Lock()
+	r.putServer("tcp@b")
+	alive := fmt.Sprint(r.aliveServers())
+	r.store.mu.Unlock()
+	_assert(alive == "[tcp@a tcp@b]", "expect the registry to serve while the disk is busy, got %s", alive)
+}
+
+func TestMyRegistry_Rules(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "myrpc-registry")
+	defer os.RemoveAll(dir)
+
+	r := New(time.Minute)
+	_assert(r.EnablePersistence(dir) == nil, "failed to enable persistence")
+	_assert(string(r.Rules()) == "[]", "expect empty rules by default")
+	_assert(r.SetRules([]byte(`{"name": "x"}`)) == errInvalidRules, "expect rules to be a JSON array")
+	rules := `[{"name": "canary", "route": {"canary": "true"}}]`
+	_assert(r.SetRules([]byte(rules)) == nil, "failed to set rules")
+	_ = r.Close()
+
+	r2 := New(time.Minute)
+	_assert(r2.EnablePersistence(dir) == nil, "failed to restore")
+	defer r2.Close()
+	_assert(string(r2.Rules()) == rules, "expect rules restored, got %s", r2.Rules())
+}
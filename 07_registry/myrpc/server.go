@@ -2,16 +2,19 @@ package myrpc
 
 import (
 	"MyRpc/07_registry/myrpc/codec"
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +26,7 @@ type Option struct {
 	CodecType		codec.Type	// 编码类型
 	ConnectTimeout	time.Duration
 	HandleTimeout	time.Duration
+	Logger			Logger `json:"-"` // 客户端的日志，为nil时使用DefaultLogger，不会发送给服务端
 }
 
 var DefaultOption = &Option{
@@ -34,11 +38,36 @@ var DefaultOption = &Option{
 // Server 代表一个MyRpc服务
 type Server struct {
 	serviceMap sync.Map
+	mu         sync.Mutex          // protect following
+	heartbeats []HeartbeatReporter // 在调试页面上展示的心跳
+	collectors []Collector         // 在指标页面上输出的指标
+	notServing int32               // 为1时健康检查返回不可用
+	metrics    *rpcMetrics         // 服务端的指标，见 serverMetrics
+	once       sync.Once           // 零值的 Server 在第一次使用时创建 metrics
+	cmu        sync.Mutex          // protect following
+	conns      map[*serverConn]struct{}     // 打开的连接，在调试页面上展示
+	running    map[*runningRequest]struct{} // 正在处理的请求，在调试页面上展示
+	accessLog  atomic.Value                 // 访问日志，见 SetAccessLog
+	logger     LoggerHolder                 // 日志，见 SetLogger
 }
 
-// NewServer 返回一个MyRpc实例
+// NewServer 返回一个MyRpc实例。Server 的零值也可以直接使用
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		metrics: newRPCMetrics(),
+		conns:   make(map[*serverConn]struct{}),
+		running: make(map[*runningRequest]struct{}),
+	}
+}
+
+// serverMetrics 返回服务端的指标，零值的 Server 在第一次使用时创建
+func (server *Server) serverMetrics() *rpcMetrics {
+	server.once.Do(func() {
+		if server.metrics == nil {
+			server.metrics = newRPCMetrics()
+		}
+	})
+	return server.metrics
 }
 
 // 找到对应的服务和方法
@@ -65,17 +94,36 @@ func (server *Server) findService(serviceMethod string) (svc *service, metType *
 	return
 }
 
-// 发布方法
+// 发布方法，receiver 不是导出的类型或服务已经存在时返回错误。
+// 发布的方法形如 func (t *T) Method(args T1, reply *T2) error，
+// 也可以在 args 前接收一个 context.Context：func (t *T) Method(ctx context.Context, args T1, reply *T2) error，
+// ctx 带有请求的元数据（见 Metadata）和调用链（见 SpanFromContext），设置了 HandleTimeout 时在超时后被取消
 func (server *Server) Register(receiver interface{}) error {
 	// 获得一个服务
-	s := newService(receiver)
+	s, err := newService(receiver)
+	if err != nil {
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		server.logger.Infof("rpc server: register %s.%s", s.name, name)
+	}
 	return nil
 }
 
-// 发布receiver的方法
+// SetLogger 设置服务端的日志，为 nil 时使用 DefaultLogger
+func (server *Server) SetLogger(l Logger) {
+	server.logger.Store(l)
+}
+
+// 发布receiver的方法，方法的形式见 Server.Register
 func Register(receiver interface{}) error {
 	return DefaultServer.Register(receiver)
 }
@@ -86,35 +134,74 @@ var DefaultServer = NewServer()
 // ServeConn runs the server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
+	var peer string
+	if c, ok := conn.(net.Conn); ok {
+		peer = c.RemoteAddr().String()
+	}
+	// 统计读写的字节数和打开的连接数
+	conn = server.serverMetrics().countReadWriteCloser(conn)
 	defer func() {
 		// 退出后关闭
 		conn.Close()
 	}()
 	// 获取编码方式
 	var option Option
-	if err := json.NewDecoder(conn).Decode(&option); err != nil {
-		log.Println("rpc server: options error: ", err)
+	decoder := json.NewDecoder(conn)
+	if err := decoder.Decode(&option); err != nil {
+		server.logger.Warnf("rpc server: options error: %v", err)
 		return
 	}
 	//检查MagicNumber和CodeType是否正确
 	if option.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", option.MagicNumber)
+		server.logger.Warnf("rpc server: invalid magic number %x", option.MagicNumber)
 		return
 	}
 	newCodec := codec.NewCodecFuncMap[option.CodecType]
 	if newCodec == nil {
-		log.Printf("rpc server: invalid codec type %s", option.CodecType)
+		server.logger.Warnf("rpc server: invalid codec type %s", option.CodecType)
 		return
 	}
 	//获取消息的解码器
 	//调用serveCodec
-	server.ServeCodec(newCodec(conn), &option)
+	server.serveCodec(newCodec(newBufferedConn(conn, decoder.Buffered())), &option, peer)
+}
+
+// bufferedConn 解析Option时，json.Decoder可能已经多读了紧跟其后的请求，
+// 读取时需要先读出这部分数据
+type bufferedConn struct {
+	reader  *bufio.Reader
+	started bool // 是否已经跳过了Option末尾的换行符
+	io.ReadWriteCloser
+}
+
+func newBufferedConn(conn io.ReadWriteCloser, buffered io.Reader) *bufferedConn {
+	reader := bufio.NewReader(io.MultiReader(buffered, conn))
+	return &bufferedConn{reader: reader, ReadWriteCloser: conn}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	// 客户端使用json.Encoder发送Option，末尾有一个换行符。
+	// 在第一次读取时才跳过它，创建时不能阻塞，否则空闲的连接不会被记录
+	if !c.started {
+		c.started = true
+		if b, err := c.reader.Peek(1); err == nil && b[0] == '\n' {
+			_, _ = c.reader.Discard(1)
+		}
+	}
+	return c.reader.Read(p)
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
 func (server *Server) ServeCodec(cc codec.Codec, opt *Option) {
+	server.serveCodec(cc, opt, "")
+}
+
+// serveCodec 处理一个连接上的请求，peer 为对端地址，未知时为空
+func (server *Server) serveCodec(cc codec.Codec, opt *Option, peer string) {
+	sc := server.trackConn(peer, opt.CodecType)
+	defer server.untrackConn(sc)
 	sending := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
 	for {
@@ -126,13 +213,18 @@ func (server *Server) ServeCodec(cc codec.Codec, opt *Option) {
 				break
 			}
 			// 返回错误信息
+			start := time.Now()
+			if req.metType != nil {
+				server.serverMetrics().method(req.header.ServiceMethod).fail(CodeBadRequest)
+			}
 			req.header.Error = err.Error()
-			server.sendResponse(cc, req.header, invalidRequest, sending)
+			size := server.sendResponse(cc, req.header, invalidRequest, sending)
+			server.logAccess(sc, req, start, CodeBadRequest, size, "")
 			continue
 		}
 		wg.Add(1)
 		//请求无误，开始处理
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout, sc)
 	}
 	//等待所有请求处理完毕
 	wg.Wait()
@@ -140,28 +232,40 @@ func (server *Server) ServeCodec(cc codec.Codec, opt *Option) {
 }
 
 // 对请求进行处理
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration, sc *serverConn) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	running := server.trackRequest(req.header.ServiceMethod, sc.peer)
+	defer server.untrackRequest(running)
+	mm := server.serverMetrics().method(req.header.ServiceMethod)
+	mm.begin()
+	start := time.Now()
+	ctx, span := serverSpan(req.header.Metadata, req.header.ServiceMethod, sc.peer)
+	// 处理超时或返回后取消 ctx，接收 context.Context 的服务方法可以据此提前结束
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	called := make(chan error)
+	sent := make(chan int64) // 响应的字节数
 	go func() {
-		err := req.service.call(req.metType, req.argv, req.replyv)
-		called <- struct{}{}
+		err := req.service.call(req.metType, ctx, req.argv, req.replyv)
+		called <- err
 		if err != nil {
 			req.header.Error = err.Error()
-			server.sendResponse(cc, req.header, invalidRequest, sending)
 			// 这里不能忘
-			sent <- struct{}{}
+			sent <- server.sendResponse(cc, req.header, invalidRequest, sending)
 			return
 		}
 		// 返回结果
-		server.sendResponse(cc, req.header, req.replyv.Interface(), sending)
-		sent <- struct{}{}
+		sent <- server.sendResponse(cc, req.header, req.replyv.Interface(), sending)
 	}()
 	// 若没有设置超时
 	if timeout == 0 {
-		<-called
-		<-sent
+		err := <-called
+		mm.end(time.Since(start), serverErrorCode(err))
+		span.finish(err)
+		server.logAccess(sc, req, start, serverErrorCode(err), <-sent, span.span.TraceID)
 		// 直接返回
 		return
 	}
@@ -171,19 +275,60 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.
 		// 本来想超时后会不会这里设置header的error后，已经开启的go程把它修改了。后来发现不会
 		// 在超时前的代码里，不会修改header.error的值
 		req.header.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.header, invalidRequest, sending)
-	case <-called:
-		<-sent
+		size := server.sendResponse(cc, req.header, invalidRequest, sending)
+		mm.end(time.Since(start), CodeTimeout)
+		span.finish(errors.New(req.header.Error))
+		server.logAccess(sc, req, start, CodeTimeout, size, span.span.TraceID)
+	case err := <-called:
+		mm.end(time.Since(start), serverErrorCode(err))
+		span.finish(err)
+		server.logAccess(sc, req, start, serverErrorCode(err), <-sent, span.span.TraceID)
+	}
+}
+
+// logAccess 在访问日志中记录一个处理完的请求，code 为空表示成功
+func (server *Server) logAccess(sc *serverConn, req *request, start time.Time, code string, responseSize int64, traceID string) {
+	l := loadAccessLog(&server.accessLog)
+	code = accessCode(code)
+	if !l.sampled(code) {
+		return
 	}
+	l.write(&server.logger, &AccessEntry{
+		Time:          start,
+		Side:          SpanKindServer,
+		Peer:          sc.peer,
+		ServiceMethod: req.header.ServiceMethod,
+		Seq:           req.header.Seq,
+		Latency:       time.Since(start),
+		Code:          code,
+		Error:         req.header.Error,
+		RequestSize:   req.size,
+		ResponseSize:  responseSize,
+		TraceID:       traceID,
+	})
 }
 
-func (server *Server) sendResponse(cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) {
+// serverErrorCode 返回服务方法返回的错误对应的错误码
+func serverErrorCode(err error) string {
+	if err != nil {
+		return CodeServerError
+	}
+	return ""
+}
+
+// sendResponse 发送响应，返回写入的字节数
+func (server *Server) sendResponse(cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) int64 {
 	sending.Lock()
 	defer sending.Unlock()
+	// 响应不需要带回请求的元数据
+	header.Metadata = nil
+	_, before := bytesCounted(cc)
 	//fmt.Println("fmt",body)
 	if err := cc.Write(header, body); err != nil {
-		log.Println("rpc server: write response error:", err)
+		server.logger.Errorf("rpc server: write response error: %v", err)
 	}
+	_, after := bytesCounted(cc)
+	return after - before
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
@@ -191,7 +336,7 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	if err := cc.ReadHeader(&header); err != nil {
 		// TODO 在哪种情况下返回eof
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Println("rpc server: read header error:", err)
+			server.logger.Warnf("rpc server: read header error: %v", err)
 		}
 		return nil, err
 	}
@@ -204,9 +349,11 @@ type request struct {
 	argv, replyv 	reflect.Value // argv and replyv of request
 	metType			*methodType	// 方法类型
 	service			*service // 服务
+	size			int64 // 请求的字节数
 }
 
 func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+	before, _ := bytesCounted(cc)
 	// 获取请求的Header
 	header, err := server.readRequestHeader(cc)
 	if err != nil 	{
@@ -215,7 +362,13 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	req := &request{header: header}
 	req.service, req.metType, err = server.findService(req.header.ServiceMethod)
 	if err != nil {
-		return nil, err
+		// 丢弃请求体后返回错误，连接可以继续使用
+		if bodyErr := cc.ReadBody(nil); bodyErr != nil {
+			return nil, bodyErr
+		}
+		after, _ := bytesCounted(cc)
+		req.size = after - before
+		return req, err
 	}
 	// 获取到的是一个实例化的值,并能够修改其值
 	req.argv = req.metType.newArgv()
@@ -228,8 +381,11 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 
 	// 获取请求的Body。argvi是一个指针类型
-	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read argv err:", err)
+	err = cc.ReadBody(argvi)
+	after, _ := bytesCounted(cc)
+	req.size = after - before
+	if err != nil {
+		server.logger.Warnf("rpc server: read argv err: %v", err)
 		return req, err
 	}
 	return req, nil
@@ -242,7 +398,7 @@ func (server *Server) Accept(lis net.Listener) {
 		// 开始监听
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			server.logger.Errorf("rpc server: accept error: %v", err)
 			return
 		}
 		//fmt.Println("server accept")
@@ -273,7 +429,7 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// 若方法为CONNECT
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		server.logger.Errorf("rpc hijacking %s: %v", req.RemoteAddr, err)
 		return
 	}
 	_, _ = io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
@@ -283,7 +439,9 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (server *Server) HandleHTTP() {
 	http.Handle(defaultRPCPath, server)
 	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+	http.Handle(defaultMetricsPath, metricsHTTP{server})
+	server.logger.Infof("rpc server debug path: %s", defaultDebugPath)
+	server.logger.Infof("rpc server metrics path: %s", defaultMetricsPath)
 }
 
 func HandleHTTP() {
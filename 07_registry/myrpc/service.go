@@ -1,8 +1,9 @@
 package myrpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
-	"log"
 	"reflect"
 	"sync/atomic"
 )
@@ -12,6 +13,7 @@ type methodType struct {
 	ArgType	reflect.Type	// 第一个参数
 	ReplyType	reflect.Type	//第二个参数
 	numCalls 	uint64	// 调用次数
+	withContext	bool	// 方法的第一个参数是否为 context.Context
 }
 
 // 调用次数增加
@@ -50,8 +52,8 @@ type service struct {
 	method map[string]*methodType  // 存储结构体符合条件的方法
 }
 
-// 获取service实例
-func newService(receiver interface{}) *service {
+// 获取service实例，receiver 的类型不是导出的类型时返回错误
+func newService(receiver interface{}) (*service, error) {
 	s := new(service)
 	// 为s赋值
 	s.receiver = reflect.ValueOf(receiver)
@@ -59,10 +61,10 @@ func newService(receiver interface{}) *service {
 	s.name = reflect.Indirect(s.receiver).Type().Name()
 	s.typ = reflect.TypeOf(receiver)
 	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+		return nil, fmt.Errorf("rpc server: %q is not a valid service name", s.name)
 	}
 	s.registerMethods()
-	return s
+	return s, nil
 }
 
 // 通过反射获该service实例的所有导出方法并复制给该service的method
@@ -73,29 +75,36 @@ func (s *service) registerMethods() {
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		metType := method.Type
-		// 检验参数数量
-		if metType.NumIn() != 3 || metType.NumOut() != 1 {
+		// 检验参数数量，方法可以在参数前接收一个 context.Context
+		withContext := metType.NumIn() == 4 && metType.In(1) == typeOfContext
+		if (metType.NumIn() != 3 && !withContext) || metType.NumOut() != 1 {
 			continue
 		}
 		//  reflect.TypeOf((*error)(nil)).Elem()的值是error
 		if metType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
 			continue
 		}
-		argType, replyType := metType.In(1), metType.In(2)
+		argType, replyType := metType.In(metType.NumIn()-2), metType.In(metType.NumIn()-1)
 		s.method[method.Name] = &methodType{
 			method: method,
 			ArgType: argType,
 			ReplyType: replyType,
+			withContext: withContext,
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
-// 通过反射执行一个方法
-func (s *service) call(metType *methodType, argsType, replyv reflect.Value) error {
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// 通过反射执行一个方法，方法接收 context.Context 时传入 ctx
+func (s *service) call(metType *methodType, ctx context.Context, argsType, replyv reflect.Value) error {
 	atomic.AddUint64(&metType.numCalls, 1)
 	metFunc := metType.method.Func
-	returnValues := metFunc.Call([]reflect.Value{s.receiver, argsType, replyv})
+	in := []reflect.Value{s.receiver, argsType, replyv}
+	if metType.withContext {
+		in = []reflect.Value{s.receiver, reflect.ValueOf(ctx), argsType, replyv}
+	}
+	returnValues := metFunc.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
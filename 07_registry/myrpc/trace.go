@@ -0,0 +1,249 @@
+package myrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentKey 是元数据中携带调用链上下文的键，值为 W3C traceparent 格式：
+// 00-<32位trace id>-<16位span id>-<2位flags>
+const TraceparentKey = "traceparent"
+
+// SpanContext 标识调用链中的一个 span
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool // 是否需要导出，由调用链的起点决定并向下游传递
+}
+
+// IsValid 判断 trace id 和 span id 是否都不为零
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent 返回 W3C traceparent 格式的字符串
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+var errInvalidTraceparent = errors.New("rpc trace: invalid traceparent")
+
+// ParseTraceparent 解析 W3C traceparent 格式的字符串。
+// 未知的版本按 00 解析其前四个字段，版本 ff 和全零的 id 无效
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errInvalidTraceparent
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errInvalidTraceparent
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(parts[0])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if !sc.IsValid() {
+		return sc, errInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+type spanKey struct{}
+
+// ContextWithSpan 返回带有 sc 的 ctx，之后通过该 ctx 发起的调用都是 sc 的子 span
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// SpanFromContext 返回 ctx 中的 span，服务方法可以通过它得到当前请求的 span
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+// SpanKind 区分 span 是客户端发起的调用还是服务端的处理
+type SpanKind string
+
+const (
+	SpanKindClient SpanKind = "client"
+	SpanKindServer SpanKind = "server"
+)
+
+// Span 是一次调用或一次处理的记录，由 Exporter 导出
+type Span struct {
+	TraceID       string    `json:"trace_id"`
+	SpanID        string    `json:"span_id"`
+	ParentSpanID  string    `json:"parent_span_id,omitempty"`
+	ServiceMethod string    `json:"service_method"`
+	Kind          SpanKind  `json:"kind"`
+	Peer          string    `json:"peer,omitempty"` // 服务端 span 的对端地址
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Exporter 导出结束的 span，需要能被并发调用
+type Exporter interface {
+	Export(span *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter 设置本进程中 Client 和 Server 导出 span 的方式，为 nil 时不导出。
+// 不论是否导出，调用链上下文都会随请求传递
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+// activeSpan 是还没有结束的 span
+type activeSpan struct {
+	sc   SpanContext
+	span Span
+}
+
+// startSpan 开始一个 span，parent 有效时作为它的子 span，否则开始一个新的调用链
+func startSpan(parent SpanContext, serviceMethod string, kind SpanKind) *activeSpan {
+	s := &activeSpan{sc: SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}}
+	if parent.IsValid() {
+		s.span.ParentSpanID = hex.EncodeToString(parent.SpanID[:])
+	} else {
+		randomID(s.sc.TraceID[:])
+		s.sc.Sampled = true
+	}
+	randomID(s.sc.SpanID[:])
+	s.span.TraceID = hex.EncodeToString(s.sc.TraceID[:])
+	s.span.SpanID = hex.EncodeToString(s.sc.SpanID[:])
+	s.span.ServiceMethod = serviceMethod
+	s.span.Kind = kind
+	s.span.Start = time.Now()
+	return s
+}
+
+// finish 结束 span，采样时交给 Exporter
+func (s *activeSpan) finish(err error) {
+	s.span.End = time.Now()
+	if err != nil {
+		s.span.Error = err.Error()
+	}
+	if e := currentExporter(); e != nil && s.sc.Sampled {
+		e.Export(&s.span)
+	}
+}
+
+// randomID 生成随机的 id，结果不会全为零
+func randomID(b []byte) {
+	for {
+		_, _ = rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+// clientSpan 为 Client 发起的调用开始一个 span，返回带有 traceparent 的元数据
+func clientSpan(ctx context.Context, serviceMethod string) (*activeSpan, map[string]string) {
+	parent, _ := SpanFromContext(ctx)
+	span := startSpan(parent, serviceMethod, SpanKindClient)
+	md := make(map[string]string, len(Metadata(ctx))+1)
+	for k, v := range Metadata(ctx) {
+		md[k] = v
+	}
+	md[TraceparentKey] = span.sc.Traceparent()
+	return span, md
+}
+
+// serverSpan 为服务端的处理开始一个 span，上游的调用链上下文从请求元数据中读取。
+// 返回的 ctx 带有请求元数据和该 span，服务方法用它发起的调用属于同一个调用链
+func serverSpan(md map[string]string, serviceMethod, peer string) (context.Context, *activeSpan) {
+	parent, _ := ParseTraceparent(md[TraceparentKey])
+	span := startSpan(parent, serviceMethod, SpanKindServer)
+	span.span.Peer = peer
+	ctx := context.Background()
+	if len(md) > 0 {
+		ctx = WithMetadata(ctx, md)
+	}
+	return ContextWithSpan(ctx, span.sc), span
+}
+
+// FileExporter 把 span 以 JSON lines 的格式追加到文件中，便于本地分析
+type FileExporter struct {
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	logger LoggerHolder
+}
+
+var _ Exporter = (*FileExporter)(nil)
+
+// NewFileExporter 打开 path 用于追加，文件不存在时创建
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// SetLogger 设置写入失败时输出日志的 Logger，为 nil 时使用 DefaultLogger
+func (e *FileExporter) SetLogger(l Logger) {
+	e.logger.Store(l)
+}
+
+// Export 写入一行 span，写入失败时记录日志并丢弃
+func (e *FileExporter) Export(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return
+	}
+	if err := e.enc.Encode(span); err != nil {
+		e.logger.Errorf("rpc trace: export span error: %v", err)
+	}
+}
+
+// Close 关闭文件，之后的 span 会被丢弃
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
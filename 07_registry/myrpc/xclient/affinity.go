@@ -0,0 +1,129 @@
+package xclient
+
+import (
+	"context"
+	"time"
+)
+
+type sessionKey struct{}
+
+// WithSessionID 为 SessionAffinitySelect 模式指定会话，同一个会话的调用会发到同一个服务上
+func WithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+// SessionID 返回 ctx 中的会话
+func SessionID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(sessionKey{}).(string)
+	return id, ok
+}
+
+// AffinityPolicy 是会话保持的策略
+type AffinityPolicy struct {
+	IdleTimeout time.Duration // 会话超过该时间没有调用时解除绑定
+}
+
+const defaultSessionIdleTimeout = time.Minute * 30
+
+// AffinityStats 是会话保持的统计
+type AffinityStats struct {
+	Sessions int    // 当前绑定的会话数
+	Hits     uint64 // 调用发到已绑定的服务的次数
+	Pins     uint64 // 新会话绑定服务的次数
+	Repins   uint64 // 绑定的服务不可用，重新绑定的次数
+}
+
+// affinityTable 记录会话绑定的服务，被 xc.amu 保护
+type affinityTable struct {
+	policy    AffinityPolicy
+	sessions  map[string]*affinityEntry
+	lastSweep time.Time
+	hits      uint64
+	pins      uint64
+	repins    uint64
+}
+
+// affinityEntry 是一个会话绑定的服务
+type affinityEntry struct {
+	addr     string // 不含元数据的地址，修改元数据不影响绑定
+	lastUsed time.Time
+}
+
+func newAffinityTable(policy AffinityPolicy) *affinityTable {
+	if policy.IdleTimeout <= 0 {
+		policy.IdleTimeout = defaultSessionIdleTimeout
+	}
+	return &affinityTable{policy: policy, sessions: make(map[string]*affinityEntry), lastSweep: time.Now()}
+}
+
+// SetAffinityPolicy 设置会话保持的策略，已有的绑定会被清空；为 nil 时使用默认策略
+func (xc *XClient) SetAffinityPolicy(policy *AffinityPolicy) {
+	var p AffinityPolicy
+	if policy != nil {
+		p = *policy
+	}
+	xc.amu.Lock()
+	defer xc.amu.Unlock()
+	xc.affinity = newAffinityTable(p)
+}
+
+// AffinityStats 返回会话保持的统计
+func (xc *XClient) AffinityStats() AffinityStats {
+	xc.amu.Lock()
+	defer xc.amu.Unlock()
+	t := xc.affinity
+	return AffinityStats{
+		Sessions: len(t.sessions),
+		Hits:     t.hits,
+		Pins:     t.pins,
+		Repins:   t.repins,
+	}
+}
+
+// affinitySelect 选择会话绑定的服务。绑定的服务不在 servers 中（下线、熔断或不健康）时，
+// 按会话在一致性哈希环上重新选择并绑定，所有客户端对同一个会话会选出同一个服务。
+// 原来的服务恢复后会话仍然留在新的服务上，避免再次丢失会话在服务上的状态。
+// 没有会话的调用按 P2C 选择
+func (xc *XClient) affinitySelect(ctx context.Context, servers []string) (string, error) {
+	id, ok := SessionID(ctx)
+	if !ok {
+		return xc.p2cSelect(servers)
+	}
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	now := time.Now()
+	xc.amu.Lock()
+	defer xc.amu.Unlock()
+	t := xc.affinity
+	t.sweepLocked(now)
+	entry, pinned := t.sessions[id]
+	if pinned {
+		for _, server := range servers {
+			if ParseInstance(server).Addr == entry.addr {
+				entry.lastUsed = now
+				t.hits++
+				return server, nil
+			}
+		}
+		t.repins++
+	} else {
+		t.pins++
+	}
+	server := xc.ringFor(servers).get(id)
+	t.sessions[id] = &affinityEntry{addr: ParseInstance(server).Addr, lastUsed: now}
+	return server, nil
+}
+
+// sweepLocked 清理空闲的会话，最多每隔 IdleTimeout 的一半清理一次。调用时需要持有xc.amu
+func (t *affinityTable) sweepLocked(now time.Time) {
+	if now.Sub(t.lastSweep) < t.policy.IdleTimeout/2 {
+		return
+	}
+	t.lastSweep = now
+	for id, entry := range t.sessions {
+		if now.Sub(entry.lastUsed) >= t.policy.IdleTimeout {
+			delete(t.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerState 熔断器的状态
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常调用
+	BreakerOpen                         // 熔断，不再向该服务发送请求
+	BreakerHalfOpen                     // 熔断一段时间后，放行少量请求探测服务是否恢复
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerPolicy 是熔断器的策略。连续失败次数达到 ConsecutiveFailures，
+// 或者一个统计窗口内调用数不少于 MinRequests 且错误率达到 ErrorRate 时熔断
+type BreakerPolicy struct {
+	ConsecutiveFailures int           // 连续失败多少次后熔断
+	ErrorRate           float64       // 熔断的错误率，0.5 表示一半的调用失败
+	MinRequests         int           // 窗口内的调用数少于该值时不按错误率熔断
+	Window              time.Duration // 统计错误率的窗口
+	OpenTimeout         time.Duration // 熔断多久后进入半开状态
+	HalfOpenProbes      int           // 半开状态下同时放行的请求数，全部成功后恢复
+}
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultErrorRate           = 0.5
+	defaultMinRequests         = 20
+	defaultBreakerWindow       = time.Second * 10
+	defaultOpenTimeout         = time.Second * 5
+	defaultHalfOpenProbes      = 1
+)
+
+func (p BreakerPolicy) withDefaults() BreakerPolicy {
+	if p.ConsecutiveFailures <= 0 {
+		p.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if p.ErrorRate <= 0 {
+		p.ErrorRate = defaultErrorRate
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = defaultMinRequests
+	}
+	if p.Window <= 0 {
+		p.Window = defaultBreakerWindow
+	}
+	if p.OpenTimeout <= 0 {
+		p.OpenTimeout = defaultOpenTimeout
+	}
+	if p.HalfOpenProbes <= 0 {
+		p.HalfOpenProbes = defaultHalfOpenProbes
+	}
+	return p
+}
+
+// ErrCircuitOpen 服务的熔断器处于打开状态，请求没有发出
+var ErrCircuitOpen = errors.New("rpc xclient: circuit breaker is open")
+
+// breaker 是一个服务的熔断器
+type breaker struct {
+	policy      *BreakerPolicy
+	mu          sync.Mutex
+	state       BreakerState
+	openedAt    time.Time // 最近一次熔断的时间
+	consecutive int       // 连续失败的次数
+	windowStart time.Time // 当前统计窗口的开始时间
+	requests    int       // 窗口内的调用数
+	failures    int       // 窗口内的失败数
+	probes      int       // 半开状态下正在进行的探测请求数
+	successes   int       // 半开状态下成功的探测请求数
+	generation  uint64    // 状态变化时递增，用于识别请求是在哪个状态下被放行的
+}
+
+// BreakerStat 是一个服务的熔断器状态的快照
+type BreakerStat struct {
+	Addr                string
+	State               BreakerState
+	ConsecutiveFailures int
+	Requests            int // 当前窗口内的调用数
+	Failures            int // 当前窗口内的失败数
+	OpenedAt            time.Time
+}
+
+func newBreaker(policy *BreakerPolicy) *breaker {
+	return &breaker{policy: policy, windowStart: time.Now()}
+}
+
+// stateLocked 返回当前的状态，熔断时间超过 OpenTimeout 后进入半开状态。调用时需要持有b.mu
+func (b *breaker) stateLocked(now time.Time) BreakerState {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.policy.OpenTimeout {
+		b.state = BreakerHalfOpen
+		b.probes, b.successes = 0, 0
+		b.generation++
+	}
+	return b.state
+}
+
+// available 判断选择服务时是否应该考虑该服务，不会占用半开状态的探测名额
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.stateLocked(time.Now()) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.probes < b.policy.HalfOpenProbes
+	default:
+		return true
+	}
+}
+
+// allow 判断是否可以发出请求，半开状态下会占用一个探测名额。
+// 返回放行时的状态版本，请求结束后与结果一起交给 done
+func (b *breaker) allow() (generation uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.stateLocked(time.Now()) {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if b.probes >= b.policy.HalfOpenProbes {
+			return 0, false
+		}
+		b.probes++
+		return b.generation, true
+	default:
+		return b.generation, true
+	}
+}
+
+// done 记录一次请求的结果，generation 为 allow 返回的版本。
+// 放行之后状态已经变化的请求不再计入，例如半开状态下只统计探测请求
+func (b *breaker) done(generation uint64, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.stateLocked(now); generation != b.generation {
+		return
+	}
+	if now.Sub(b.windowStart) >= b.policy.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+	switch b.stateLocked(now) {
+	case BreakerHalfOpen:
+		b.probes--
+		if failed {
+			b.tripLocked(now)
+		} else if b.successes++; b.successes >= b.policy.HalfOpenProbes {
+			b.state = BreakerClosed
+			b.windowStart, b.requests, b.failures, b.consecutive = now, 0, 0, 0
+			b.generation++
+		}
+	case BreakerClosed:
+		if b.consecutive >= b.policy.ConsecutiveFailures ||
+			(b.requests >= b.policy.MinRequests && float64(b.failures) >= float64(b.requests)*b.policy.ErrorRate) {
+			b.tripLocked(now)
+		}
+	}
+}
+
+func (b *breaker) tripLocked(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.probes, b.successes = 0, 0
+	b.generation++
+}
+
+func (b *breaker) stat(addr string) BreakerStat {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStat{
+		Addr:                addr,
+		State:               b.stateLocked(time.Now()),
+		ConsecutiveFailures: b.consecutive,
+		Requests:            b.requests,
+		Failures:            b.failures,
+		OpenedAt:            b.openedAt,
+	}
+}
+
+// breakerFailure 判断错误是否应该计入熔断：服务端返回的错误说明服务是正常的，
+// 调用方主动取消（如对冲请求中失败的一方）也与服务无关
+func breakerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var serverErr ServerError
+	return !errors.As(err, &serverErr)
+}
+
+// SetBreakerPolicy 为每个服务启用熔断器，熔断的服务不会被选择；为 nil 时关闭熔断
+func (xc *XClient) SetBreakerPolicy(policy *BreakerPolicy) {
+	xc.bmu.Lock()
+	defer xc.bmu.Unlock()
+	xc.breakers = make(map[string]*breaker)
+	if policy == nil {
+		xc.breakerPolicy = nil
+		return
+	}
+	p := policy.withDefaults()
+	xc.breakerPolicy = &p
+}
+
+// breakerFor 返回 server 的熔断器，没有启用熔断时返回 nil
+func (xc *XClient) breakerFor(server string) *breaker {
+	xc.bmu.Lock()
+	defer xc.bmu.Unlock()
+	if xc.breakerPolicy == nil {
+		return nil
+	}
+	addr := ParseInstance(server).Addr
+	b, ok := xc.breakers[addr]
+	if !ok {
+		b = newBreaker(xc.breakerPolicy)
+		xc.breakers[addr] = b
+	}
+	return b
+}
+
+func (xc *XClient) breakerAvailable(server string) bool {
+	b := xc.breakerFor(server)
+	return b == nil || b.available()
+}
+
+// BreakerStats 返回每个服务的熔断器状态，按地址排序
+func (xc *XClient) BreakerStats() []BreakerStat {
+	xc.bmu.Lock()
+	breakers := make(map[string]*breaker, len(xc.breakers))
+	for addr, b := range xc.breakers {
+		breakers[addr] = b
+	}
+	xc.bmu.Unlock()
+	stats := make([]BreakerStat, 0, len(breakers))
+	for addr, b := range breakers {
+		stats = append(stats, b.stat(addr))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
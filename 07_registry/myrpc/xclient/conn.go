@@ -0,0 +1,432 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConnPolicy 是 XClient 管理连接的策略。XClient 定期与服务发现对账，
+// 关闭已经下线的服务的连接，并清理空闲的连接
+type ConnPolicy struct {
+	PoolSize       int           // 到每个服务最多建立的连接数，连接都在使用时才建立新的连接
+	MaxIdle        int           // 最多保留的空闲连接数，超过时关闭最久没有使用的
+	IdleTimeout    time.Duration // 空闲连接超过该时间没有使用时关闭
+	CleanInterval  time.Duration // 对账和清理的间隔
+	DialBackoff    time.Duration // 建立连接失败后，等待多久再尝试，每次失败翻倍
+	MaxDialBackoff time.Duration // 等待时间的上限
+}
+
+const (
+	defaultPoolSize       = 1
+	defaultMaxIdle        = 32
+	defaultIdleTimeout    = time.Minute * 5
+	defaultCleanInterval  = time.Second * 30
+	defaultDialBackoff    = time.Millisecond * 100
+	defaultMaxDialBackoff = time.Second * 10
+)
+
+func (p ConnPolicy) withDefaults() ConnPolicy {
+	if p.PoolSize <= 0 {
+		p.PoolSize = defaultPoolSize
+	}
+	if p.MaxIdle <= 0 {
+		p.MaxIdle = defaultMaxIdle
+	}
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = defaultIdleTimeout
+	}
+	if p.CleanInterval <= 0 {
+		p.CleanInterval = defaultCleanInterval
+	}
+	if p.DialBackoff <= 0 {
+		p.DialBackoff = defaultDialBackoff
+	}
+	if p.MaxDialBackoff <= 0 {
+		p.MaxDialBackoff = defaultMaxDialBackoff
+	}
+	return p
+}
+
+// errDialBackoff 上一次建立连接失败后还没有到下一次尝试的时间
+var errDialBackoff = errors.New("rpc xclient: dial backoff")
+
+// connPool 是到一个服务的一组连接，按需增加到 PoolSize 个。被 xc.mu 保护
+type connPool struct {
+	conns    []*pooledConn
+	dialing  int           // 正在建立的连接数，建立时不持有xc.mu
+	dialed   chan struct{} // 有连接建立结束时关闭并替换，用于等待
+	draining bool          // 服务已经下线，不再取出连接，连接在调用结束后关闭
+	closed   bool          // XClient 已经关闭，之后建立的连接直接关闭
+}
+
+func newConnPool() *connPool {
+	return &connPool{dialed: make(chan struct{})}
+}
+
+// pooledConn 是连接池中的一个连接
+type pooledConn struct {
+	*Client
+	inflight int64     // 正在使用该连接的调用数
+	lastUsed time.Time // 最近一次被使用的时间，被 xc.mu 保护
+}
+
+func (c *pooledConn) pending() int64 {
+	return atomic.LoadInt64(&c.inflight)
+}
+
+// acquire 取出连接，用完后需要调用 release。调用时需要持有xc.mu
+func (c *pooledConn) acquire() *pooledConn {
+	atomic.AddInt64(&c.inflight, 1)
+	c.lastUsed = time.Now()
+	return c
+}
+
+// release 在调用结束后归还连接
+func (c *pooledConn) release() {
+	atomic.AddInt64(&c.inflight, -1)
+}
+
+// leastLoaded 返回正在进行的调用最少的连接，池为空时返回 nil
+func (p *connPool) leastLoaded() *pooledConn {
+	var best *pooledConn
+	for _, c := range p.conns {
+		if best == nil || c.pending() < best.pending() {
+			best = c
+		}
+	}
+	return best
+}
+
+// removeUnavailable 关闭并移除已经不可用的连接
+func (p *connPool) removeUnavailable() {
+	conns := p.conns[:0]
+	for _, c := range p.conns {
+		if c.IsAvailable() {
+			conns = append(conns, c)
+		} else {
+			_ = c.Close()
+		}
+	}
+	p.conns = conns
+}
+
+// remove 关闭并移除连接 c
+func (p *connPool) remove(c *pooledConn) {
+	for i := range p.conns {
+		if p.conns[i] == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	_ = c.Close()
+}
+
+func (p *connPool) close() {
+	for _, c := range p.conns {
+		_ = c.Close()
+	}
+	p.conns = nil
+	p.closed = true
+}
+
+// drain 关闭没有调用在使用的连接，返回是否还有连接在使用或在建立
+func (p *connPool) drain() bool {
+	conns := p.conns[:0]
+	for _, c := range p.conns {
+		if c.pending() > 0 {
+			conns = append(conns, c)
+		} else {
+			_ = c.Close()
+		}
+	}
+	p.conns = conns
+	return len(p.conns) > 0 || p.dialing > 0
+}
+
+// PoolStat 是到一个服务的连接池的快照
+type PoolStat struct {
+	Addr     string
+	Conns    int   // 连接数
+	Idle     int   // 没有调用在使用的连接数
+	Inflight int64 // 所有连接上正在进行的调用数
+}
+
+// dialState 记录一个服务建立连接失败的情况
+type dialState struct {
+	failures int       // 连续失败的次数
+	next     time.Time // 下一次可以尝试的时间
+	err      error     // 最近一次失败的错误
+}
+
+// SetConnPolicy 设置管理连接的策略，为 nil 时使用默认策略
+func (xc *XClient) SetConnPolicy(policy *ConnPolicy) {
+	var p ConnPolicy
+	if policy != nil {
+		p = *policy
+	}
+	p = p.withDefaults()
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.connPolicy = p
+	// 已经开始清理时按新的间隔重新开始
+	if xc.stopClean != nil {
+		xc.stopCleanLocked()
+		xc.startCleanLocked()
+	}
+}
+
+// startCleanLocked 开始后台的清理，第一次建立连接时调用，Close 时停止。调用时需要持有xc.mu
+func (xc *XClient) startCleanLocked() {
+	if xc.stopClean == nil {
+		xc.stopClean = make(chan struct{})
+		go xc.cleanLoop(xc.connPolicy.CleanInterval, xc.stopClean)
+	}
+}
+
+// stopCleanLocked 停止后台的清理。调用时需要持有xc.mu
+func (xc *XClient) stopCleanLocked() {
+	if xc.stopClean != nil {
+		close(xc.stopClean)
+		xc.stopClean = nil
+	}
+}
+
+func (xc *XClient) cleanLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			xc.clean()
+		}
+	}
+}
+
+// dial 从到 rpcAddr 的连接池中取出正在进行的调用最少的连接，用完后需要调用 release。
+// 所有连接都在使用并且连接数少于 PoolSize 时建立新的连接，建立连接时不持有xc.mu，
+// 连接数已满并且都在建立中时等待，ctx 结束时不再等待。
+// 建立连接失败后，在退避时间内不再尝试，池为空时直接返回错误
+func (xc *XClient) dial(ctx context.Context, rpcAddr string) (*pooledConn, error) {
+	addr := ParseInstance(rpcAddr).Addr
+	for {
+		xc.mu.Lock()
+		pool, ok := xc.clients[addr]
+		if !ok {
+			pool = newConnPool()
+			xc.clients[addr] = pool
+		}
+		pool.removeUnavailable()
+		best := pool.leastLoaded()
+		if best != nil && (best.pending() == 0 || len(pool.conns)+pool.dialing >= xc.connPolicy.PoolSize) {
+			best.acquire()
+			xc.mu.Unlock()
+			return best, nil
+		}
+		if best == nil && pool.dialing >= xc.connPolicy.PoolSize {
+			// 等待正在建立的连接，之后重新选择
+			wait := pool.dialed
+			xc.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-wait:
+			}
+			continue
+		}
+		if ds, ok := xc.dials[addr]; ok && time.Now().Before(ds.next) {
+			if best != nil {
+				best.acquire()
+			} else if pool.dialing == 0 {
+				delete(xc.clients, addr)
+			}
+			xc.mu.Unlock()
+			if best != nil {
+				return best, nil
+			}
+			return nil, fmt.Errorf("%w after %d failures: %v", errDialBackoff, ds.failures, ds.err)
+		}
+		// 预留一个连接的位置，建立连接时不阻塞其他调用
+		pool.dialing++
+		xc.mu.Unlock()
+		client, err := xc.dialContext(ctx, rpcAddr)
+		return xc.dialed(ctx, addr, pool, client, err)
+	}
+}
+
+// dialed 在建立连接结束后释放预留的位置，成功时把连接放入池中，失败时记录退避
+func (xc *XClient) dialed(ctx context.Context, addr string, pool *connPool, client *Client, err error) (*pooledConn, error) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	pool.dialing--
+	close(pool.dialed)
+	pool.dialed = make(chan struct{})
+	if err == nil {
+		delete(xc.dials, addr)
+		if pool.closed {
+			// XClient 已经关闭
+			_ = client.Close()
+			return nil, ErrShutdown
+		}
+		// 服务下线后池在排空，连接在这次调用结束后被关闭
+		c := &pooledConn{Client: client}
+		pool.conns = append(pool.conns, c)
+		xc.startCleanLocked()
+		return c.acquire(), nil
+	}
+	if ctx.Err() == nil {
+		ds, ok := xc.dials[addr]
+		if !ok {
+			ds = new(dialState)
+			xc.dials[addr] = ds
+		}
+		ds.failures++
+		ds.err = err
+		ds.next = time.Now().Add(Backoff(xc.connPolicy.DialBackoff, xc.connPolicy.MaxDialBackoff, ds.failures))
+		// 退回到已有的连接
+		if best := pool.leastLoaded(); best != nil && !pool.draining && !pool.closed {
+			return best.acquire(), nil
+		}
+	}
+	// ctx 结束说明调用方已经放弃，不是服务的问题，不计入退避
+	if xc.clients[addr] == pool && len(pool.conns) == 0 && pool.dialing == 0 {
+		delete(xc.clients, addr)
+	}
+	return nil, err
+}
+
+type dialResult struct {
+	client *Client
+	err    error
+}
+
+// dialContext 建立到 rpcAddr 的连接，ctx 结束时返回 ctx.Err()，之后建立的连接会被关闭
+func (xc *XClient) dialContext(ctx context.Context, rpcAddr string) (*Client, error) {
+	ch := make(chan dialResult, 1)
+	go func() {
+		client, err := XDial(rpcAddr, xc.opt)
+		ch <- dialResult{client: client, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.client != nil {
+				_ = r.client.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.client, r.err
+	}
+}
+
+// idleConn 是一个空闲的连接及其所在的连接池
+type idleConn struct {
+	pool *connPool
+	conn *pooledConn
+}
+
+// clean 排空已经下线的服务的连接池并清理它们的统计，池中的连接在调用结束后关闭。
+// 再关闭不可用的连接和空闲太久的连接，空闲连接超过 MaxIdle 时关闭最久没有使用的
+func (xc *XClient) clean() {
+	var alive map[string]bool
+	if servers, err := xc.discovery.GetAll(); err == nil {
+		alive = make(map[string]bool, len(servers))
+		for _, server := range servers {
+			alive[ParseInstance(server).Addr] = true
+		}
+		xc.pruneStats(alive)
+	}
+	now := time.Now()
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	var idle []idleConn
+	for addr, pool := range xc.clients {
+		if alive != nil && !alive[addr] {
+			pool.draining = true
+			xc.draining = append(xc.draining, pool)
+			delete(xc.clients, addr)
+			continue
+		}
+		pool.removeUnavailable()
+		for _, c := range append([]*pooledConn(nil), pool.conns...) {
+			if c.pending() > 0 {
+				continue
+			}
+			if now.Sub(c.lastUsed) >= xc.connPolicy.IdleTimeout {
+				pool.remove(c)
+				continue
+			}
+			idle = append(idle, idleConn{pool: pool, conn: c})
+		}
+	}
+	if alive != nil {
+		for addr := range xc.dials {
+			if !alive[addr] {
+				delete(xc.dials, addr)
+			}
+		}
+	}
+	if len(idle) > xc.connPolicy.MaxIdle {
+		sort.Slice(idle, func(i, j int) bool { return idle[i].conn.lastUsed.Before(idle[j].conn.lastUsed) })
+		for _, ic := range idle[:len(idle)-xc.connPolicy.MaxIdle] {
+			ic.pool.remove(ic.conn)
+		}
+	}
+	for addr, pool := range xc.clients {
+		if len(pool.conns) == 0 && pool.dialing == 0 {
+			delete(xc.clients, addr)
+		}
+	}
+	draining := xc.draining[:0]
+	for _, pool := range xc.draining {
+		if pool.drain() {
+			draining = append(draining, pool)
+		}
+	}
+	xc.draining = draining
+}
+
+// PoolStats 返回每个服务的连接池的状态，按地址排序
+func (xc *XClient) PoolStats() []PoolStat {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	stats := make([]PoolStat, 0, len(xc.clients))
+	for addr, pool := range xc.clients {
+		stat := PoolStat{Addr: addr, Conns: len(pool.conns)}
+		for _, c := range pool.conns {
+			if n := c.pending(); n > 0 {
+				stat.Inflight += n
+			} else {
+				stat.Idle++
+			}
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// pruneStats 清理已经下线的服务的调用统计和熔断器
+func (xc *XClient) pruneStats(alive map[string]bool) {
+	xc.smu.Lock()
+	for addr, s := range xc.stats {
+		if !alive[addr] && s.pending() == 0 {
+			delete(xc.stats, addr)
+		}
+	}
+	xc.smu.Unlock()
+	xc.bmu.Lock()
+	for addr := range xc.breakers {
+		if !alive[addr] {
+			delete(xc.breakers, addr)
+		}
+	}
+	xc.bmu.Unlock()
+}
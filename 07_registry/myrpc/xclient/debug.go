@@ -0,0 +1,188 @@
+package xclient
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+const debugText = `<html>
+	<body>
+	<title>MyRPC XClient</title>
+	<hr>
+	Servers
+	<hr>
+		<table>
+		<th align=center>Addr</th><th align=center>Inflight</th><th align=center>Latency</th><th align=center>Failures / Requests</th>
+		{{range .Servers}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=center>{{.Inflight}}</td>
+			<td align=center>{{.Latency}}</td>
+			<td align=center>{{.Failures}} / {{.Requests}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{if .Pools}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>Addr</th><th align=center>Conns</th><th align=center>Idle</th><th align=center>Inflight</th>
+		{{range .Pools}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=center>{{.Conns}}</td>
+			<td align=center>{{.Idle}}</td>
+			<td align=center>{{.Inflight}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Health}}
+	<hr>
+	Health
+	<hr>
+		<table>
+		<th align=center>Addr</th><th align=center>Healthy</th><th align=center>Last check</th><th align=center>Last error</th><th align=center>Ejected until</th><th align=center>Ejections</th>
+		{{range .Health}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=center>{{.Healthy}}</td>
+			<td align=center>{{if .LastCheck.IsZero}}never{{else}}{{.LastCheck.Format "2006-01-02 15:04:05"}}{{end}}</td>
+			<td align=left>{{.LastError}}</td>
+			<td align=center>{{if .Ejected}}{{.EjectedUntil.Format "2006-01-02 15:04:05"}}{{else}}-{{end}}</td>
+			<td align=center>{{.Ejections}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Breakers}}
+	<hr>
+	Circuit breakers
+	<hr>
+		<table>
+		<th align=center>Addr</th><th align=center>State</th><th align=center>Consecutive failures</th><th align=center>Failures / Requests</th><th align=center>Opened at</th>
+		{{range .Breakers}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=center>{{.State}}</td>
+			<td align=center>{{.ConsecutiveFailures}}</td>
+			<td align=center>{{.Failures}} / {{.Requests}}</td>
+			<td align=center>{{if .OpenedAt.IsZero}}never{{else}}{{.OpenedAt.Format "2006-01-02 15:04:05"}}{{end}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{if .Zone.Zone}}
+	<hr>
+	Zone {{.Zone.Zone}}
+	<hr>
+		<table>
+		<th align=center>Local</th><th align=center>Remote</th><th align=center>Local share</th>
+			<tr>
+			<td align=center>{{.Zone.Local}}</td>
+			<td align=center>{{.Zone.Remote}}</td>
+			<td align=center>{{printf "%.1f%%" (percent .Zone.LocalShare)}}</td>
+			</tr>
+		</table>
+	{{end}}
+	{{if .Affinity.Sessions}}
+	<hr>
+	Session affinity
+	<hr>
+		<table>
+		<th align=center>Sessions</th><th align=center>Hits</th><th align=center>Pins</th><th align=center>Repins</th>
+			<tr>
+			<td align=center>{{.Affinity.Sessions}}</td>
+			<td align=center>{{.Affinity.Hits}}</td>
+			<td align=center>{{.Affinity.Pins}}</td>
+			<td align=center>{{.Affinity.Repins}}</td>
+			</tr>
+		</table>
+	{{end}}
+	{{if .Mirror.Mirrored}}
+	<hr>
+	Mirroring
+	<hr>
+		<table>
+		<th align=center>Mirrored</th><th align=center>Equal</th><th align=center>Different</th><th align=center>Errors</th><th align=center>Skipped</th><th align=center>Dropped</th>
+			<tr>
+			<td align=center>{{.Mirror.Mirrored}}</td>
+			<td align=center>{{.Mirror.Equal}}</td>
+			<td align=center>{{.Mirror.Different}}</td>
+			<td align=center>{{.Mirror.Errors}}</td>
+			<td align=center>{{.Mirror.Skipped}}</td>
+			<td align=center>{{.Mirror.Dropped}}</td>
+			</tr>
+		</table>
+		{{if .Mirror.Diffs}}
+		<table>
+		<th align=center>Time</th><th align=center>Method</th><th align=center>Shadow server</th><th align=center>Production</th><th align=center>Shadow</th>
+		{{range .Mirror.Diffs}}
+			<tr>
+			<td align=center>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+			<td align=left font=fixed>{{.ServiceMethod}}</td>
+			<td align=left font=fixed>{{.Server}}</td>
+			<td align=left>{{.Production}}</td>
+			<td align=left>{{.Shadow}}</td>
+			</tr>
+		{{end}}
+		</table>
+		{{end}}
+	{{end}}
+	{{if .Hedge.Calls}}
+	<hr>
+	Hedging
+	<hr>
+		<table>
+		<th align=center>Calls</th><th align=center>Hedged</th><th align=center>Won</th><th align=center>Delay</th>
+			<tr>
+			<td align=center>{{.Hedge.Calls}}</td>
+			<td align=center>{{.Hedge.Hedged}}</td>
+			<td align=center>{{.Hedge.Won}}</td>
+			<td align=center>{{.Hedge.Delay}}</td>
+			</tr>
+		</table>
+	{{end}}
+	</body>
+	</html>`
+
+var debug = template.Must(template.New("XClient debug").Funcs(template.FuncMap{
+	"percent": func(f float64) float64 { return f * 100 },
+}).Parse(debugText))
+
+type debugData struct {
+	Servers  []ServerStat
+	Pools    []PoolStat
+	Health   []HealthStat
+	Breakers []BreakerStat
+	Zone     ZoneStats
+	Affinity AffinityStats
+	Mirror   MirrorReport
+	Hedge    HedgeStats
+}
+
+// ServeHTTP 展示每个服务的调用统计、连接池、健康状态和熔断器状态
+func (xc *XClient) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data := debugData{
+		Servers:  xc.ServerStats(),
+		Pools:    xc.PoolStats(),
+		Health:   xc.HealthStats(),
+		Breakers: xc.BreakerStats(),
+		Zone:     xc.ZoneStats(),
+		Affinity: xc.AffinityStats(),
+		Mirror:   xc.MirrorReport(),
+		Hedge:    xc.HedgeStats(),
+	}
+	err := debug.Execute(w, data)
+	if err != nil {
+		_, _ = fmt.Fprintln(w, "rpc xclient: error executing template:", err.Error())
+	}
+}
+
+// HandleHTTP 在 path 上注册 XClient 的调试页面
+func (xc *XClient) HandleHTTP(path string) {
+	http.Handle(path, xc)
+	xc.logger.Infof("rpc xclient debug path: %s", path)
+}
@@ -14,6 +14,13 @@ type SelectMode int
 const (
 	RandomSelect     SelectMode = iota // select randomly
 	RoundRobinSelect                   // select using Robbin algorithm
+	WeightedRandomSelect               // 按实例的权重随机选择
+	WeightedRoundRobinSelect           // 平滑加权轮询，与 nginx 的算法相同
+	ConsistentHashSelect               // 按路由key一致性哈希，由XClient完成，见WithRoutingKey
+	LeastPendingSelect                 // 选择正在进行的调用最少的服务，由XClient完成
+	P2CSelect                          // 随机取两个服务，选择延迟和负载较小的一个，由XClient完成
+	ZoneAwareSelect                    // 优先选择同一个可用区的服务，由XClient完成，见SetZonePolicy
+	SessionAffinitySelect              // 同一个会话的调用发到同一个服务，由XClient完成，见WithSessionID
 )
 
 type Discovery interface {
@@ -25,10 +32,14 @@ type Discovery interface {
 
 var _ Discovery = (*MultiServersDiscovery)(nil)
 
+var errNoServers = errors.New("rpc discovery: no available servers")
+
 type MultiServersDiscovery struct {
 	rd 		*rand.Rand // 随机数
 	mu 		sync.RWMutex
 	servers []string // 已注册的服务
+	instances	[]Instance // 解析了元数据的服务，与servers一一对应
+	current	map[string]int // 平滑加权轮询中每个实例的当前权重，以Instance.Addr为键
 	index 	int // 位置
 }
 
@@ -37,20 +48,36 @@ func (d *MultiServersDiscovery) Refresh() error {
 }
 
 // Update the servers of discovery dynamically if needed
+// 实例的权重可以通过地址中的元数据修改，已有实例的加权轮询状态会被保留
 func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServersLocked(servers)
 	return nil
 }
 
+// 更新服务列表，并清理已经不存在的实例的状态。调用时需要持有d.mu
+func (d *MultiServersDiscovery) setServersLocked(servers []string) {
+	d.servers = servers
+	d.instances = parseInstances(servers)
+	alive := make(map[string]bool, len(d.instances))
+	for _, ins := range d.instances {
+		alive[ins.Addr] = true
+	}
+	for addr := range d.current {
+		if !alive[addr] {
+			delete(d.current, addr)
+		}
+	}
+}
+
 // Get 根据对应的模式选择一个服务
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	n := len(d.servers)
 	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
+		return "", errNoServers
 	}
 	switch mode {
 	case RandomSelect:
@@ -59,11 +86,61 @@ func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 		ser := d.servers[d.index % n]
 		d.index = (d.index + 1) % n
 		return ser, nil
+	case WeightedRandomSelect:
+		return d.weightedRandom()
+	case WeightedRoundRobinSelect:
+		return d.weightedRoundRobin()
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
 }
 
+var errNoWeightedServers = errors.New("rpc discovery: no servers with positive weight")
+
+// 按权重随机选择，权重为w的实例被选中的概率为 w/总权重。调用时需要持有d.mu
+func (d *MultiServersDiscovery) weightedRandom() (string, error) {
+	total := 0
+	for _, ins := range d.instances {
+		total += ins.Weight
+	}
+	if total == 0 {
+		return "", errNoWeightedServers
+	}
+	r := d.rd.Intn(total)
+	for _, ins := range d.instances {
+		if r < ins.Weight {
+			return ins.Server, nil
+		}
+		r -= ins.Weight
+	}
+	return "", errNoWeightedServers
+}
+
+// 平滑加权轮询：每次给所有实例的当前权重加上各自的权重，选出当前权重最大的实例，
+// 再把它的当前权重减去总权重。权重为5、1、1时的顺序为 a a b a c a a。调用时需要持有d.mu
+func (d *MultiServersDiscovery) weightedRoundRobin() (string, error) {
+	if d.current == nil {
+		d.current = make(map[string]int)
+	}
+	total := 0
+	best := -1
+	for i, ins := range d.instances {
+		if ins.Weight == 0 {
+			continue
+		}
+		total += ins.Weight
+		d.current[ins.Addr] += ins.Weight
+		if best < 0 || d.current[ins.Addr] > d.current[d.instances[best].Addr] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", errNoWeightedServers
+	}
+	d.current[d.instances[best].Addr] -= total
+	return d.instances[best].Server, nil
+}
+
 // GetAll 获取所有的服务
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 	d.mu.RLock()
@@ -76,9 +153,10 @@ func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 // NewMultiServerDiscovery 获取一个实例
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d := &MultiServersDiscovery{
-		servers: servers,
 		rd:	rand.New(rand.NewSource(time.Now().UnixNano())), // 产生随机数
+		current: make(map[string]int),
 	}
+	d.setServersLocked(servers)
 	d.index = d.rd.Intn(math.MaxInt32 - 1)
 	return d
 }
\ No newline at end of file
@@ -1,7 +1,9 @@
 package xclient
 
 import (
-	"log"
+	. "MyRpc/07_registry/myrpc"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -9,65 +11,227 @@ import (
 
 type MyRegistryDiscovery struct {
 	*MultiServersDiscovery
-	registry 	string	// 注册中心地址
+	registries 	[]string	// 注册中心地址，有多个时依次尝试
+	registryIndex	int		// 最近一次成功的注册中心的位置
 	timeout		time.Duration	// 服务列表的过期时间，过期后需要重新获取
 	lastUpdate 	time.Time	// 从注册中心更新服务列表的时间
+	maxStaleness	time.Duration	// 注册中心不可用时，过期的服务列表最多还能使用多久
+	refreshing	chan struct{}	// 正在进行的刷新，完成后关闭；没有刷新时为nil
+	lastAttempt	time.Time	// 最近一次开始刷新的时间
+	lastErr		error		// 最近一次刷新的错误
+	refreshes	uint64		// 刷新的次数
+	refreshErrors	uint64		// 刷新失败的次数
+	logger		LoggerHolder	// 日志，见 SetLogger
 }
 
-const defaultUpdateTimeout = time.Second * 10
+// DiscoveryStats 服务发现的状态，可用于监控
+type DiscoveryStats struct {
+	Servers       int           // 当前的服务数量
+	LastUpdate    time.Time     // 最近一次成功更新的时间
+	Staleness     time.Duration // 服务列表距离上次更新的时间
+	Refreshes     uint64        // 向注册中心刷新的次数
+	RefreshErrors uint64        // 刷新失败的次数
+	LastError     string        // 最近一次刷新的错误，成功后清空
+}
+
+const (
+	defaultUpdateTimeout = time.Second * 10
+	// 与注册中心默认的过期时间一致，超过后缓存的服务很可能已经全部失效
+	defaultMaxStaleness = time.Minute * 5
+)
+
+var errRefreshing = errors.New("refreshing servers from registry")
+
+// 请求注册中心的超时时间，超时后尝试下一个注册中心
+var registryClient = &http.Client{Timeout: time.Second * 5}
 
 // 创建一个实例
 func NewMyRegistryDiscovery(registerAddr string, timeout time.Duration) *MyRegistryDiscovery {
+	return NewMyRegistryClusterDiscovery([]string{registerAddr}, timeout)
+}
+
+// NewMyRegistryClusterDiscovery 从注册中心集群获取服务列表，一个注册中心不可用时尝试下一个
+func NewMyRegistryClusterDiscovery(registries []string, timeout time.Duration) *MyRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
 	}
 	d := &MyRegistryDiscovery{
 		MultiServersDiscovery: 	NewMultiServerDiscovery(make([]string, 0)),
-		registry: 				registerAddr,
+		registries: 			registries,
 		timeout:				timeout,
+		maxStaleness:			defaultMaxStaleness,
 	}
 	return d
 }
 
+// SetMaxStaleness 设置注册中心不可用时，过期的服务列表最多还能使用多久。
+// 为负数时不限制
+func (d *MyRegistryDiscovery) SetMaxStaleness(maxStaleness time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.maxStaleness = maxStaleness
+}
+
 // 手动更新服务器列表
 func (d *MyRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServersLocked(servers)
 	d.lastUpdate = time.Now()
 	return nil
 }
 
 // 从注册中心刷新服务器列表
 func (d *MyRegistryDiscovery) Refresh() error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.mu.RLock()
+	fresh := d.lastUpdate.Add(d.timeout).After(time.Now())
+	d.mu.RUnlock()
 	// 若还未过期，直接返回
-	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+	if fresh {
 		return nil
 	}
-	log.Println("rpc registry: refresh servers from registry", d.registry)
-	// 从注册中心获取服务
-	resp, err := http.Get(d.registry)
+	return d.refresh()
+}
+
+// refresh 向注册中心请求服务列表，请求期间不持有锁。
+// 同一时间只有一个请求，其他调用等待它的结果
+func (d *MyRegistryDiscovery) refresh() error {
+	d.mu.Lock()
+	if done := d.refreshing; done != nil {
+		d.mu.Unlock()
+		<-done
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return d.lastErr
+	}
+	done := make(chan struct{})
+	d.refreshing = done
+	d.lastAttempt = time.Now()
+	start := d.registryIndex
+	d.mu.Unlock()
+
+	servers, index, err := d.fetch(start)
+
+	d.mu.Lock()
+	d.refreshing = nil
+	d.refreshes++
+	d.lastErr = err
 	if err != nil {
-		log.Println("rpc registry refresh err:", err)
-		return err
+		d.refreshErrors++
+	} else {
+		d.setServersLocked(servers)
+		d.registryIndex = index
+		// 更新时间
+		d.lastUpdate = time.Now()
+	}
+	d.mu.Unlock()
+	close(done)
+	return err
+}
+
+// SetLogger 设置服务发现的日志，为 nil 时使用 DefaultLogger
+func (d *MyRegistryDiscovery) SetLogger(l Logger) {
+	d.logger.Store(l)
+}
+
+// fetch 从第start个注册中心开始依次尝试，返回服务列表和成功的注册中心
+func (d *MyRegistryDiscovery) fetch(start int) ([]string, int, error) {
+	var resp *http.Response
+	var err error
+	index := start
+	for i := 0; i < len(d.registries); i++ {
+		index = (start + i) % len(d.registries)
+		d.logger.Debugf("rpc registry: refresh servers from registry %s", d.registries[index])
+		if resp, err = fetchServers(d.registries[index]); err == nil {
+			break
+		}
+		d.logger.Warnf("rpc registry refresh err: %v", err)
 	}
-	servers := strings.Split(resp.Header.Get("X-Myrpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
+	if err != nil {
+		return nil, start, err
+	}
+	list := strings.Split(resp.Header.Get("X-Myrpc-Servers"), ",")
+	servers := make([]string, 0, len(list))
+	for _, server := range list {
 		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, server)
+			servers = append(servers, server)
 		}
 	}
-	// 更新时间
-	d.lastUpdate = time.Now()
+	return servers, index, nil
+}
+
+// 向注册中心请求服务列表
+func fetchServers(registry string) (*http.Response, error) {
+	resp, err := registryClient.Get(registry)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// ensureFresh 保证服务列表可用：
+// 未过期时直接使用；过期但不超过 maxStaleness 时继续使用缓存，并在后台刷新；
+// 从未获取过或超过 maxStaleness 时同步刷新，失败则返回错误。
+// 超过 maxStaleness 后同样每个过期时间只刷新一次，其间直接返回错误
+func (d *MyRegistryDiscovery) ensureFresh() error {
+	d.mu.RLock()
+	age := time.Since(d.lastUpdate)
+	loaded := !d.lastUpdate.IsZero()
+	usable := loaded && (d.maxStaleness < 0 || age <= d.maxStaleness)
+	// 刷新失败后，等待一个过期时间再重试，避免注册中心不可用时每次调用都发起请求
+	retry := d.refreshing == nil && time.Since(d.lastAttempt) >= d.timeout
+	lastErr := d.lastErr
+	d.mu.RUnlock()
+	if age < d.timeout {
+		return nil
+	}
+	if !usable && loaded && !retry {
+		if lastErr == nil {
+			lastErr = errRefreshing
+		}
+		return fmt.Errorf("rpc discovery: servers stale for %s: %v", age.Round(time.Second), lastErr)
+	}
+	if !usable {
+		err := d.refresh()
+		if err != nil && loaded {
+			return fmt.Errorf("rpc discovery: servers stale for %s: %v", age.Round(time.Second), err)
+		}
+		return err
+	}
+	if retry {
+		go func() {
+			_ = d.refresh()
+		}()
+	}
 	return nil
 }
 
+// Stats 返回服务发现的状态
+func (d *MyRegistryDiscovery) Stats() DiscoveryStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	stats := DiscoveryStats{
+		Servers:       len(d.servers),
+		LastUpdate:    d.lastUpdate,
+		Refreshes:     d.refreshes,
+		RefreshErrors: d.refreshErrors,
+	}
+	if !d.lastUpdate.IsZero() {
+		stats.Staleness = time.Since(d.lastUpdate)
+	}
+	if d.lastErr != nil {
+		stats.LastError = d.lastErr.Error()
+	}
+	return stats
+}
+
 // 获取服务
 func (d *MyRegistryDiscovery) Get(mode SelectMode) (string, error) {
-	if err := d.Refresh(); err != nil {
+	if err := d.ensureFresh(); err != nil {
 		return "", err
 	}
 	return d.MultiServersDiscovery.Get(mode)
@@ -75,10 +239,8 @@ func (d *MyRegistryDiscovery) Get(mode SelectMode) (string, error) {
 
 // 获取所有服务
 func (d *MyRegistryDiscovery) GetAll() ([]string, error) {
-	if err := d.Refresh(); err != nil {
+	if err := d.ensureFresh(); err != nil {
 		return nil, err
 	}
 	return d.MultiServersDiscovery.GetAll()
 }
-
-
@@ -0,0 +1,176 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"MyRpc/07_registry/myrpc/registry"
+	"context"
+	"sync"
+	"time"
+)
+
+// MyRegistryRPCDiscovery 通过 MyRPC 调用注册中心的 Registry 服务获取服务列表，
+// 并在后台使用 Registry.Watch 等待列表变化，不需要定期轮询
+type MyRegistryRPCDiscovery struct {
+	*MultiServersDiscovery
+	registry string     // 注册中心的 rpc 地址，格式为 protocol@addr
+	opt      *Option    // 连接注册中心的选项
+	cmu      sync.Mutex // protect following
+	client   *Client
+	version  uint64 // 当前服务列表的版本
+	loaded   bool   // 是否已经从注册中心获取过列表
+	stop     chan struct{}
+	once     sync.Once
+	logger   LoggerHolder // 日志，见 SetLogger
+}
+
+var _ Discovery = (*MyRegistryRPCDiscovery)(nil)
+
+const (
+	watchTimeout    = time.Second * 30
+	watchRetryDelay = time.Second
+)
+
+// NewMyRegistryRPCDiscovery 创建一个实例并开始在后台监听服务列表的变化
+func NewMyRegistryRPCDiscovery(registryAddr string, opt *Option) *MyRegistryRPCDiscovery {
+	d := &MyRegistryRPCDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		registry:              registryAddr,
+		opt:                   opt,
+		stop:                  make(chan struct{}),
+	}
+	go d.watch()
+	return d
+}
+
+// SetLogger 设置服务发现的日志，为 nil 时使用 DefaultLogger
+func (d *MyRegistryRPCDiscovery) SetLogger(l Logger) {
+	d.logger.Store(l)
+}
+
+// 获取到注册中心的连接，连接不可用时重新建立
+func (d *MyRegistryRPCDiscovery) dial() (*Client, error) {
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+	if d.client != nil && d.client.IsAvailable() {
+		return d.client, nil
+	}
+	if d.client != nil {
+		_ = d.client.Close()
+		d.client = nil
+	}
+	client, err := XDial(d.registry, d.opt)
+	if err != nil {
+		return nil, err
+	}
+	d.client = client
+	return client, nil
+}
+
+// update 用注册中心返回的列表更新本地的服务列表
+func (d *MyRegistryRPCDiscovery) update(reply *registry.ListReply) {
+	d.cmu.Lock()
+	d.version = reply.Version
+	d.loaded = true
+	d.cmu.Unlock()
+	_ = d.MultiServersDiscovery.Update(reply.Servers)
+}
+
+// Refresh 立即从注册中心获取一次服务列表
+func (d *MyRegistryRPCDiscovery) Refresh() error {
+	client, err := d.dial()
+	if err != nil {
+		return err
+	}
+	var reply registry.ListReply
+	if err = client.Call(WithoutTelemetry(context.Background()), "Registry.List", registry.ListArgs{}, &reply); err != nil {
+		return err
+	}
+	d.update(&reply)
+	return nil
+}
+
+// watch 在后台等待服务列表的变化，出错后稍等片刻重试
+func (d *MyRegistryRPCDiscovery) watch() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		if err := d.watchOnce(); err != nil {
+			d.logger.Warnf("rpc discovery: watch registry %s err: %v", d.registry, err)
+			select {
+			case <-d.stop:
+				return
+			case <-time.After(watchRetryDelay):
+			}
+		}
+	}
+}
+
+func (d *MyRegistryRPCDiscovery) watchOnce() error {
+	client, err := d.dial()
+	if err != nil {
+		return err
+	}
+	d.cmu.Lock()
+	version := d.version
+	d.cmu.Unlock()
+	// 留出一些余量，超时应当由注册中心先触发。长轮询不计入客户端指标，否则会拉高延迟的分位数
+	ctx, cancel := context.WithTimeout(WithoutTelemetry(context.Background()), watchTimeout+time.Second*5)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var reply registry.ListReply
+	args := registry.WatchArgs{Version: version, Timeout: watchTimeout}
+	if err = client.Call(ctx, "Registry.Watch", args, &reply); err != nil {
+		return err
+	}
+	d.update(&reply)
+	return nil
+}
+
+func (d *MyRegistryRPCDiscovery) ensureLoaded() error {
+	d.cmu.Lock()
+	loaded := d.loaded
+	d.cmu.Unlock()
+	if loaded {
+		return nil
+	}
+	return d.Refresh()
+}
+
+// Get 根据负载均衡策略选择一个服务，第一次调用时同步获取服务列表
+func (d *MyRegistryRPCDiscovery) Get(mode SelectMode) (string, error) {
+	if err := d.ensureLoaded(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+// GetAll 返回所有服务，第一次调用时同步获取服务列表
+func (d *MyRegistryRPCDiscovery) GetAll() ([]string, error) {
+	if err := d.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+// Close 停止监听并关闭到注册中心的连接
+func (d *MyRegistryRPCDiscovery) Close() error {
+	d.once.Do(func() {
+		close(d.stop)
+	})
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+	if d.client != nil {
+		_ = d.client.Close()
+		d.client = nil
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"MyRpc/07_registry/myrpc/registry"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestMyRegistryDiscovery_Failover(t *testing.T) {
+	var servers []*httptest.Server
+	var registries []string
+	for i := 0; i < 3; i++ {
+		ts := httptest.NewServer(registry.New(time.Minute))
+		defer ts.Close()
+		servers = append(servers, ts)
+		registries = append(registries, ts.URL)
+	}
+	for _, ts := range servers[1:] {
+		h := registry.Heartbeat(ts.URL, "tcp@a", time.Hour)
+		defer h.Stop()
+	}
+
+	d := NewMyRegistryClusterDiscovery(registries, time.Millisecond)
+	// 不使用过期的缓存，每次都同步刷新
+	d.SetMaxStaleness(time.Millisecond)
+	servers[0].Close()
+	all, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(all) == "[tcp@a]", "expect discovery fail over, got %v %v", all, err)
+
+	servers[1].Close()
+	time.Sleep(time.Millisecond * 2)
+	all, err = d.GetAll()
+	_assert(err == nil && fmt.Sprint(all) == "[tcp@a]", "expect discovery use the last registry, got %v %v", all, err)
+
+	servers[2].Close()
+	time.Sleep(time.Millisecond * 2)
+	_, err = d.GetAll()
+	_assert(err != nil, "expect error when every registry is down")
+}
+
+func TestMyRegistryDiscovery_StaleOnError(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	h := registry.Heartbeat(ts.URL, "tcp@a", time.Hour)
+	defer h.Stop()
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Millisecond*10)
+	d.SetMaxStaleness(time.Millisecond * 300)
+	all, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(all) == "[tcp@a]", "expect [tcp@a], got %v %v", all, err)
+
+	// 注册中心不可用后，继续使用缓存的列表，并在后台刷新
+	ts.Close()
+	time.Sleep(time.Millisecond * 20)
+	server, err := d.Get(RandomSelect)
+	_assert(err == nil && server == "tcp@a", "expect stale server served, got %q %v", server, err)
+	deadline := time.Now().Add(time.Second)
+	for d.Stats().RefreshErrors == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	stats := d.Stats()
+	_assert(stats.RefreshErrors > 0 && stats.LastError != "" && stats.Staleness > 0, "expect refresh errors recorded, got %+v", stats)
+
+	// 超过最大过期时间后返回错误
+	time.Sleep(time.Millisecond * 300)
+	_, err = d.Get(RandomSelect)
+	_assert(err != nil, "expect error once the list is too stale")
+}
+
+func TestMyRegistryDiscovery_StaleThrottle(t *testing.T) {
+	r := registry.New(time.Minute)
+	var requests, down int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	h := registry.Heartbeat(ts.URL, "tcp@a", time.Hour)
+	defer h.Stop()
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Millisecond*200)
+	d.SetMaxStaleness(time.Millisecond)
+	_, err := d.GetAll()
+	_assert(err == nil, "failed to load servers: %v", err)
+	atomic.StoreInt32(&down, 1)
+	time.Sleep(time.Millisecond * 210)
+	before := atomic.LoadInt32(&requests)
+	_, err = d.GetAll()
+	_assert(err != nil, "expect error once the list is too stale")
+
+	// 一个过期时间内不再同步请求注册中心，直接返回错误
+	for i := 0; i < 10; i++ {
+		_, err = d.GetAll()
+		_assert(err != nil, "expect stale error")
+	}
+	_assert(atomic.LoadInt32(&requests)-before == 1, "expect one refresh per timeout, got %d", atomic.LoadInt32(&requests)-before)
+	time.Sleep(time.Millisecond * 210)
+	_, _ = d.GetAll()
+	_assert(atomic.LoadInt32(&requests)-before == 2, "expect a refresh after the timeout, got %d", atomic.LoadInt32(&requests)-before)
+}
+
+func TestMyRegistryRPCDiscovery(t *testing.T) {
+	r := registry.New(time.Minute)
+	server := NewServer()
+	_assert(r.HandleRPC(server) == nil, "failed to register the registry service")
+	lis, _ := net.Listen("tcp", ":0")
+	defer lis.Close()
+	go server.Accept(lis)
+	// HTTP 和 RPC 共享同一个注册中心的状态
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	h := registry.Heartbeat(ts.URL, "tcp@a", time.Hour)
+	defer h.Stop()
+
+	d := NewMyRegistryRPCDiscovery("tcp@"+lis.Addr().String(), nil)
+	defer d.Close()
+	all, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(all) == "[tcp@a]", "expect [tcp@a], got %v %v", all, err)
+
+	client, err := XDial("tcp@" + lis.Addr().String())
+	_assert(err == nil, "failed to dial registry: %v", err)
+	defer client.Close()
+	var added bool
+	err = client.Call(context.Background(), "Registry.Register", registry.ServerArgs{Addr: "tcp@b"}, &added)
+	_assert(err == nil && added, "failed to register over rpc: %v", err)
+
+	// Watch 在后台收到变化后更新列表
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if all, _ = d.GetAll(); len(all) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(fmt.Sprint(all) == "[tcp@a tcp@b]", "expect watch to pick up tcp@b, got %v", all)
+
+	err = client.Call(context.Background(), "Registry.Deregister", registry.ServerArgs{Addr: "tcp@a"}, &added)
+	_assert(err == nil && added, "failed to deregister over rpc: %v", err)
+	resp, err := http.Get(ts.URL)
+	_assert(err == nil && resp.Header.Get("X-Myrpc-Servers") == "tcp@b", "expect http front end see the deregistration")
+	_ = resp.Body.Close()
+}
+
+func TestParseInstance(t *testing.T) {
+	ins := ParseInstance("tcp@127.0.0.1:8000?weight=3&zone=a")
+	_assert(ins.Addr == "tcp@127.0.0.1:8000" && ins.Weight == 3 && ins.Meta["zone"] == "a", "wrong instance %+v", ins)
+	ins = ParseInstance("tcp@127.0.0.1:8000")
+	_assert(ins.Addr == ins.Server && ins.Weight == 1 && len(ins.Meta) == 0, "wrong instance %+v", ins)
+}
+
+func TestMultiServersDiscovery_WeightedRoundRobin(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a?weight=5", "b?weight=1", "c?weight=1"})
+	var seq string
+	for i := 0; i < 7; i++ {
+		server, _ := d.Get(WeightedRoundRobinSelect)
+		seq += server[:1]
+	}
+	_assert(seq == "aabacaa", "expect smooth sequence aabacaa, got %s", seq)
+
+	// 修改权重不重置状态：a 的当前权重保留，b 被移除后其状态被清理
+	_, _ = d.Get(WeightedRoundRobinSelect)
+	before := d.current["a"]
+	_ = d.Update([]string{"a?weight=1", "c?weight=1"})
+	_assert(d.current["a"] == before, "expect state of a kept across Update")
+	_, ok := d.current["b"]
+	_assert(!ok, "expect state of removed server dropped")
+
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		server, _ := d.Get(WeightedRoundRobinSelect)
+		counts[server]++
+	}
+	diff := counts["a?weight=1"] - counts["c?weight=1"]
+	_assert(diff >= -2 && diff <= 2, "expect even split after update, got %v", counts)
+}
+
+func TestMultiServersDiscovery_WeightedRandom(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a?weight=3", "b?weight=1", "c?weight=0"})
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		server, err := d.Get(WeightedRandomSelect)
+		_assert(err == nil, "unexpected error %v", err)
+		counts[server[:1]]++
+	}
+	_assert(counts["c"] == 0, "expect zero weight never selected")
+	_assert(counts["a"] > 2700 && counts["a"] < 3300, "expect about 3/4 to a, got %v", counts)
+
+	_ = d.Update([]string{"a?weight=0"})
+	_, err := d.Get(WeightedRandomSelect)
+	_assert(err != nil, "expect error when every weight is zero")
+}
@@ -0,0 +1,124 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// GatherMode 决定 Gather 什么时候结束
+type GatherMode int
+
+const (
+	GatherAll      GatherMode = iota // 等待所有服务返回，一个服务失败不影响其他调用
+	GatherFailFast                   // 任何一个服务失败时取消其他调用，与 Broadcast 相同
+	GatherQuorum                     // Quorum 个服务成功后取消其他调用
+	GatherRace                       // 第一个成功的服务返回后取消其他调用
+)
+
+// GatherOption 是 Gather 的选项
+type GatherOption struct {
+	Mode   GatherMode
+	Quorum int // GatherQuorum 模式下需要成功的服务数，为 0 时为多数派
+}
+
+// Result 是 Gather 中一个服务的调用结果
+type Result struct {
+	Addr    string        // 服务地址
+	Reply   interface{}   // 与 reply 类型相同的新值，调用失败时为零值
+	Error   error         // 调用的错误，被取消的调用为 context.Canceled
+	Latency time.Duration // 调用的耗时
+}
+
+// ErrQuorumNotReached 成功的服务数不可能达到 Quorum
+var ErrQuorumNotReached = errors.New("rpc xclient: quorum not reached")
+
+// need 返回 n 个服务中需要成功的服务数
+func (opt GatherOption) need(n int) int {
+	switch opt.Mode {
+	case GatherRace:
+		return 1
+	case GatherQuorum:
+		if opt.Quorum > 0 {
+			return opt.Quorum
+		}
+		return n/2 + 1
+	default:
+		return n
+	}
+}
+
+// Gather 并发地调用所有可用的服务，返回每个服务的结果，顺序与服务列表相同。
+// reply 会被设置为第一个成功的结果，为 nil 时不设置。
+// 返回前会等待所有调用结束，被取消的调用很快就会返回
+func (xc *XClient) Gather(ctx context.Context, serviceMethod string, args, reply interface{}, opt GatherOption) ([]Result, error) {
+	servers, err := xc.availableServers()
+	if err != nil {
+		return nil, err
+	}
+	return xc.gather(ctx, servers, serviceMethod, args, reply, opt)
+}
+
+// gather 并发地调用 servers 中的每个服务
+func (xc *XClient) gather(ctx context.Context, servers []string, serviceMethod string, args, reply interface{}, opt GatherOption) ([]Result, error) {
+	if len(servers) == 0 {
+		return nil, errNoServers
+	}
+	need := opt.need(len(servers))
+	if need > len(servers) {
+		return nil, fmt.Errorf("%w: need %d servers but only %d available", ErrQuorumNotReached, need, len(servers))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]Result, len(servers))
+	done := make(chan int, len(servers))
+	for i, server := range servers {
+		go func(i int, server string) {
+			cloned := cloneReply(reply)
+			start := time.Now()
+			err := xc.call(server, ctx, serviceMethod, args, cloned)
+			results[i] = Result{Addr: server, Reply: cloned, Error: err, Latency: time.Since(start)}
+			done <- i
+		}(i, server)
+	}
+
+	var succeeded, failed int
+	var firstErr, e error
+	replyDone, decided := false, false
+	for n := 0; n < len(servers); n++ {
+		r := results[<-done]
+		if r.Error == nil {
+			succeeded++
+			if !replyDone {
+				setReply(reply, r.Reply)
+				replyDone = true
+			}
+		} else if failed++; firstErr == nil {
+			firstErr = r.Error
+		}
+		if decided {
+			continue
+		}
+		switch opt.Mode {
+		case GatherFailFast:
+			if r.Error != nil {
+				decided, e = true, r.Error
+				cancel() // if any call failed, cancel unfinished calls
+			}
+		case GatherQuorum, GatherRace:
+			if succeeded >= need {
+				decided = true
+				cancel()
+			} else if failed > len(servers)-need {
+				decided = true
+				e = fmt.Errorf("%w: %d of %d servers succeeded, need %d: %v", ErrQuorumNotReached, succeeded, len(servers), need, firstErr)
+				cancel()
+			}
+		}
+	}
+	if opt.Mode == GatherAll && failed > 0 {
+		e = fmt.Errorf("rpc xclient: %d of %d calls failed: %w", failed, len(servers), firstErr)
+	}
+	return results, e
+}
@@ -0,0 +1,93 @@
+package xclient
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// 每个实例在哈希环上的虚拟节点数，越多分布越均匀
+const defaultReplicas = 160
+
+// hashRing 是带虚拟节点的一致性哈希环。实例以 Instance.Addr 放到环上，
+// 修改元数据不会改变实例在环上的位置；增删实例时只有约 1/n 的 key 会移动
+type hashRing struct {
+	replicas int
+	hashes   []uint64          // 排好序的虚拟节点
+	nodes    map[uint64]string // 虚拟节点对应的服务
+	servers  []string          // 构建环时的服务列表，用于判断是否需要重建
+}
+
+func newHashRing(servers []string, replicas int) *hashRing {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &hashRing{
+		replicas: replicas,
+		nodes:    make(map[uint64]string),
+		servers:  servers,
+	}
+	for _, ins := range parseInstances(servers) {
+		for i := 0; i < replicas; i++ {
+			h := hashKey(strconv.Itoa(i) + "#" + ins.Addr)
+			if _, dup := r.nodes[h]; dup {
+				continue
+			}
+			r.nodes[h] = ins.Server
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get 返回顺时针方向第一个不小于 key 的哈希值的虚拟节点所对应的服务
+func (r *hashRing) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// sameServers 判断环是否是由 servers 构建的
+func (r *hashRing) sameServers(servers []string) bool {
+	return equalServers(r.servers, servers)
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return mix64(h.Sum64())
+}
+
+// mix64 打散 fnv 的结果，相近的 key 也能均匀分布在环上
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+type routingKey struct{}
+
+// WithRoutingKey 为一致性哈希模式指定请求的路由 key，相同 key 的请求会落到同一个服务上
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKey{}, key)
+}
+
+// RoutingKey 返回 ctx 中的路由 key
+func RoutingKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(routingKey{}).(string)
+	return key, ok
+}
+
+// KeyFunc 根据方法和参数计算路由 key，ctx 中没有指定 key 时使用
+type KeyFunc func(serviceMethod string, args interface{}) string
@@ -0,0 +1,70 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func moved(before, after *hashRing, keys int) int {
+	n := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if ParseInstance(before.get(key)).Addr != ParseInstance(after.get(key)).Addr {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHashRing_Redistribution(t *testing.T) {
+	var servers []string
+	for i := 0; i < 10; i++ {
+		servers = append(servers, fmt.Sprintf("tcp@10.0.0.%d:8000", i))
+	}
+	const keys = 20000
+	ring := newHashRing(servers, defaultReplicas)
+
+	// 负载大致均匀
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[ring.get(fmt.Sprintf("user-%d", i))]++
+	}
+	for server, n := range counts {
+		_assert(n > keys/10/2 && n < keys/10*2, "unbalanced ring: %s got %d keys", server, n)
+	}
+
+	// 增加一个服务，理想情况下移动 1/11 的 key
+	added := newHashRing(append(append([]string{}, servers...), "tcp@10.0.0.10:8000"), defaultReplicas)
+	n := moved(ring, added, keys)
+	t.Logf("add one server: %d/%d keys moved", n, keys)
+	_assert(n < keys*15/100, "too many keys moved after adding a server: %d", n)
+
+	// 删除一个服务，只有原来在它上面的 key 移动
+	removed := newHashRing(servers[1:], defaultReplicas)
+	n = moved(ring, removed, keys)
+	_assert(n == counts[servers[0]], "expect only keys of the removed server moved, got %d want %d", n, counts[servers[0]])
+
+	// 修改元数据不改变位置
+	changed := append([]string{servers[0] + "?weight=5"}, servers[1:]...)
+	_assert(moved(ring, newHashRing(changed, defaultReplicas), keys) == 0, "expect metadata change not to move keys")
+}
+
+func TestXClient_HashSelect(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	xc := NewXClient(d, ConsistentHashSelect, nil)
+	defer xc.Close()
+	ctx := WithRoutingKey(context.Background(), "user-42")
+	first, err := xc.selectServer(ctx, "Foo.Sum", nil)
+	_assert(err == nil, "unexpected error %v", err)
+	for i := 0; i < 10; i++ {
+		server, _ := xc.selectServer(ctx, "Foo.Sum", nil)
+		_assert(server == first, "expect same key on the same server")
+	}
+
+	xc.SetKeyFunc(func(serviceMethod string, args interface{}) string {
+		return fmt.Sprint(args)
+	})
+	server, _ := xc.selectServer(context.Background(), "Foo.Sum", "user-42")
+	_assert(server == first, "expect key func give the same route as the context key")
+}
@@ -0,0 +1,392 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckPolicy 是主动健康检查的策略：定期调用每个服务的 Health.Check，
+// 不可用的服务不会被选择，比注册中心的心跳过期更快地发现故障。
+// 没有调用 RegisterHealth 的服务只检查是否能够调用
+type HealthCheckPolicy struct {
+	Interval           time.Duration // 检查的间隔
+	Timeout            time.Duration // 每次检查的超时时间
+	UnhealthyThreshold int           // 连续失败多少次后认为服务不可用
+	HealthyThreshold   int           // 不可用的服务连续成功多少次后恢复
+}
+
+const (
+	defaultHealthInterval     = time.Second * 5
+	defaultHealthTimeout      = time.Second
+	defaultUnhealthyThreshold = 2
+	defaultHealthyThreshold   = 1
+)
+
+func (p HealthCheckPolicy) withDefaults() HealthCheckPolicy {
+	if p.Interval <= 0 {
+		p.Interval = defaultHealthInterval
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultHealthTimeout
+	}
+	if p.UnhealthyThreshold <= 0 {
+		p.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if p.HealthyThreshold <= 0 {
+		p.HealthyThreshold = defaultHealthyThreshold
+	}
+	return p
+}
+
+// OutlierPolicy 是离群检测的策略：定期比较各个服务在这段时间内的调用，
+// 错误率或延迟明显高于其他服务的会被驱逐一段时间，每次被驱逐的时间递增
+type OutlierPolicy struct {
+	Interval           time.Duration // 检测的间隔，每次统计这段时间内的调用
+	MinRequests        int           // 间隔内调用数少于该值的服务不参与检测
+	ErrorRateDelta     float64       // 错误率比其他服务的平均值高出该值时驱逐，如 0.3
+	LatencyFactor      float64       // 平均延迟超过其他服务中位数的该倍数时驱逐
+	BaseEjectionTime   time.Duration // 第 n 次驱逐的时间为 n * BaseEjectionTime
+	MaxEjectionTime    time.Duration // 驱逐时间的上限
+	MaxEjectionPercent float64       // 同时被驱逐的服务最多占的比例
+}
+
+const (
+	defaultOutlierInterval    = time.Second * 10
+	defaultOutlierMinRequests = 10
+	defaultErrorRateDelta     = 0.3
+	defaultLatencyFactor      = 3
+	defaultBaseEjectionTime   = time.Second * 30
+	defaultMaxEjectionTime    = time.Minute * 5
+	defaultMaxEjectionPercent = 0.5
+)
+
+func (p OutlierPolicy) withDefaults() OutlierPolicy {
+	if p.Interval <= 0 {
+		p.Interval = defaultOutlierInterval
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = defaultOutlierMinRequests
+	}
+	if p.ErrorRateDelta <= 0 {
+		p.ErrorRateDelta = defaultErrorRateDelta
+	}
+	if p.LatencyFactor <= 0 {
+		p.LatencyFactor = defaultLatencyFactor
+	}
+	if p.BaseEjectionTime <= 0 {
+		p.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if p.MaxEjectionTime <= 0 {
+		p.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	if p.MaxEjectionPercent <= 0 {
+		p.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return p
+}
+
+var errNotServing = errors.New("rpc xclient: server is not serving")
+
+// serverHealth 是一个服务的健康检查和离群检测的状态
+type serverHealth struct {
+	unhealthy    bool      // 主动检查认为服务不可用
+	failures     int       // 连续检查失败的次数
+	successes    int       // 不可用后连续检查成功的次数
+	lastCheck    time.Time // 最近一次检查的时间
+	lastErr      string    // 最近一次检查的错误
+	ejectedUntil time.Time // 被驱逐到什么时候
+	ejections    int       // 被驱逐的次数，决定下一次驱逐的时间；不再离群时逐渐减少
+	lastRequests uint64    // 上一次离群检测时的调用数
+	lastFailures uint64    // 上一次离群检测时的失败数
+}
+
+// HealthStat 是一个服务的健康状态的快照
+type HealthStat struct {
+	Addr         string
+	Healthy      bool      // 主动检查的结果
+	LastCheck    time.Time // 最近一次检查的时间，没有启用检查时为零值
+	LastError    string    // 最近一次检查的错误
+	Ejected      bool      // 是否正在被驱逐
+	EjectedUntil time.Time
+	Ejections    int
+}
+
+// healthForLocked 返回 addr 的健康状态。调用时需要持有xc.omu
+func (xc *XClient) healthForLocked(addr string) *serverHealth {
+	h, ok := xc.health[addr]
+	if !ok {
+		h = new(serverHealth)
+		xc.health[addr] = h
+	}
+	return h
+}
+
+// pruneHealthLocked 清理已经不在服务列表中的服务的状态。调用时需要持有xc.omu
+func (xc *XClient) pruneHealthLocked(servers []string) {
+	alive := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		alive[ParseInstance(server).Addr] = true
+	}
+	for addr := range xc.health {
+		if !alive[addr] {
+			delete(xc.health, addr)
+		}
+	}
+}
+
+// healthy 判断服务是否通过了健康检查并且没有被驱逐
+func (xc *XClient) healthy(server string) bool {
+	addr := ParseInstance(server).Addr
+	xc.omu.Lock()
+	defer xc.omu.Unlock()
+	h, ok := xc.health[addr]
+	return !ok || (!h.unhealthy && !time.Now().Before(h.ejectedUntil))
+}
+
+// SetHealthCheck 开始定期检查每个服务的健康状态，为 nil 时停止检查
+func (xc *XClient) SetHealthCheck(policy *HealthCheckPolicy) {
+	xc.omu.Lock()
+	defer xc.omu.Unlock()
+	if xc.stopHealth != nil {
+		close(xc.stopHealth)
+		xc.stopHealth = nil
+	}
+	for _, h := range xc.health {
+		h.unhealthy, h.failures, h.successes = false, 0, 0
+	}
+	if policy == nil {
+		return
+	}
+	p := policy.withDefaults()
+	xc.stopHealth = make(chan struct{})
+	go xc.healthCheckLoop(&p, xc.stopHealth)
+}
+
+func (xc *XClient) healthCheckLoop(p *HealthCheckPolicy, stop chan struct{}) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		xc.checkHealth(p)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth 并发地检查所有服务
+func (xc *XClient) checkHealth(p *HealthCheckPolicy) {
+	servers, err := xc.discovery.GetAll()
+	if err != nil {
+		return
+	}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			errs[i] = xc.probe(server, p.Timeout)
+		}(i, server)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	xc.omu.Lock()
+	defer xc.omu.Unlock()
+	xc.pruneHealthLocked(servers)
+	for i, server := range servers {
+		h := xc.healthForLocked(ParseInstance(server).Addr)
+		h.lastCheck = now
+		if errs[i] != nil {
+			h.lastErr = errs[i].Error()
+			h.successes = 0
+			if h.failures++; h.failures >= p.UnhealthyThreshold {
+				h.unhealthy = true
+			}
+			continue
+		}
+		h.lastErr = ""
+		h.failures = 0
+		if h.unhealthy {
+			if h.successes++; h.successes >= p.HealthyThreshold {
+				h.unhealthy, h.successes = false, 0
+			}
+		}
+	}
+}
+
+// probe 调用服务的 Health.Check。不认识该方法的服务能够返回错误，说明服务是可用的。
+// 探测不计入客户端指标和访问日志，也不开始 span
+func (xc *XClient) probe(server string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(WithoutTelemetry(context.Background()), timeout)
+	defer cancel()
+	conn, err := xc.dial(ctx, server)
+	if err != nil {
+		return err
+	}
+	defer conn.release()
+	var reply HealthReply
+	err = conn.Call(ctx, HealthServiceMethod, HealthArgs{}, &reply)
+	var serverErr ServerError
+	if errors.As(err, &serverErr) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !reply.Serving {
+		return errNotServing
+	}
+	return nil
+}
+
+// SetOutlierPolicy 开始定期检测并驱逐离群的服务，为 nil 时停止检测
+func (xc *XClient) SetOutlierPolicy(policy *OutlierPolicy) {
+	xc.omu.Lock()
+	defer xc.omu.Unlock()
+	if xc.stopOutlier != nil {
+		close(xc.stopOutlier)
+		xc.stopOutlier = nil
+	}
+	for _, h := range xc.health {
+		h.ejectedUntil, h.ejections = time.Time{}, 0
+	}
+	if policy == nil {
+		return
+	}
+	p := policy.withDefaults()
+	xc.stopOutlier = make(chan struct{})
+	go xc.outlierLoop(&p, xc.stopOutlier)
+}
+
+func (xc *XClient) outlierLoop(p *OutlierPolicy, stop chan struct{}) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			xc.detectOutliers(p)
+		}
+	}
+}
+
+// outlierSample 是一个服务在一次检测间隔内的调用情况
+type outlierSample struct {
+	addr     string
+	errRate  float64
+	latency  float64
+	requests uint64
+	failures uint64
+}
+
+// detectOutliers 比较每个服务与其他服务在这段时间内的错误率和延迟，驱逐明显更差的服务
+func (xc *XClient) detectOutliers(p *OutlierPolicy) {
+	servers, err := xc.discovery.GetAll()
+	if err != nil {
+		return
+	}
+	all := make([]outlierSample, 0, len(servers))
+	for _, server := range servers {
+		s := xc.statsFor(server)
+		all = append(all, outlierSample{
+			addr:     ParseInstance(server).Addr,
+			latency:  s.latency(),
+			requests: atomic.LoadUint64(&s.requests),
+			failures: atomic.LoadUint64(&s.failures),
+		})
+	}
+
+	now := time.Now()
+	xc.omu.Lock()
+	defer xc.omu.Unlock()
+	xc.pruneHealthLocked(servers)
+	ejected := 0
+	var samples []outlierSample
+	for _, s := range all {
+		h := xc.healthForLocked(s.addr)
+		if now.Before(h.ejectedUntil) {
+			ejected++
+		}
+		requests, failures := s.requests-h.lastRequests, s.failures-h.lastFailures
+		h.lastRequests, h.lastFailures = s.requests, s.failures
+		if requests < uint64(p.MinRequests) {
+			continue
+		}
+		s.errRate = float64(failures) / float64(requests)
+		samples = append(samples, s)
+	}
+	maxEjected := int(float64(len(servers)) * p.MaxEjectionPercent)
+	for i, s := range samples {
+		h := xc.healthForLocked(s.addr)
+		if !isOutlier(p, s, samples, i) {
+			if h.ejections > 0 && !now.Before(h.ejectedUntil) {
+				h.ejections--
+			}
+			continue
+		}
+		if now.Before(h.ejectedUntil) || ejected >= maxEjected {
+			continue
+		}
+		h.ejections++
+		d := p.BaseEjectionTime * time.Duration(h.ejections)
+		if d > p.MaxEjectionTime {
+			d = p.MaxEjectionTime
+		}
+		h.ejectedUntil = now.Add(d)
+		ejected++
+	}
+}
+
+// isOutlier 判断 samples[i] 的错误率是否比其他服务的平均值高出 ErrorRateDelta，
+// 或者延迟超过其他服务中位数的 LatencyFactor 倍
+func isOutlier(p *OutlierPolicy, s outlierSample, samples []outlierSample, i int) bool {
+	if len(samples) < 2 {
+		return false
+	}
+	var errRate float64
+	latencies := make([]float64, 0, len(samples)-1)
+	for j, peer := range samples {
+		if j == i {
+			continue
+		}
+		errRate += peer.errRate
+		latencies = append(latencies, peer.latency)
+	}
+	errRate /= float64(len(latencies))
+	if s.errRate-errRate >= p.ErrorRateDelta {
+		return true
+	}
+	sort.Float64s(latencies)
+	median := latencies[len(latencies)/2]
+	return median > 0 && s.latency > median*p.LatencyFactor
+}
+
+// HealthStats 返回每个服务的健康状态，按地址排序
+func (xc *XClient) HealthStats() []HealthStat {
+	now := time.Now()
+	xc.omu.Lock()
+	defer xc.omu.Unlock()
+	stats := make([]HealthStat, 0, len(xc.health))
+	for addr, h := range xc.health {
+		stats = append(stats, HealthStat{
+			Addr:         addr,
+			Healthy:      !h.unhealthy,
+			LastCheck:    h.lastCheck,
+			LastError:    h.lastErr,
+			Ejected:      now.Before(h.ejectedUntil),
+			EjectedUntil: h.ejectedUntil,
+			Ejections:    h.ejections,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
@@ -0,0 +1,207 @@
+package xclient
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HedgePolicy 是对冲请求的策略：调用在一段时间内没有返回时，向另一个服务再发送一次，
+// 使用先成功的结果并取消另一个。只应当用于幂等的调用
+type HedgePolicy struct {
+	Delay      time.Duration                   // 发送第二次调用前的等待时间
+	Percentile float64                         // 大于 0 时使用最近调用延迟的该分位数作为等待时间，如 0.95；样本不足时使用 Delay
+	Idempotent func(serviceMethod string) bool // 判断方法是否幂等，只对幂等的方法对冲；为 nil 时所有方法都对冲
+}
+
+// HedgeStats 是对冲请求的统计
+type HedgeStats struct {
+	Calls  uint64        // 可以对冲的调用数
+	Hedged uint64        // 发送了第二次调用的次数
+	Won    uint64        // 第二次调用先成功的次数
+	Delay  time.Duration // 当前的等待时间
+}
+
+const (
+	defaultHedgeDelay = time.Millisecond * 10
+	hedgeSamples      = 256 // 计算分位数时保留的最近样本数
+	minHedgeSamples   = 20  // 样本数少于该值时不使用分位数
+	hedgeRecompute    = 16  // 每增加多少个样本重新计算一次分位数
+)
+
+// hedger 记录对冲调用的延迟样本和统计
+type hedger struct {
+	policy  HedgePolicy
+	calls   uint64
+	hedged  uint64
+	won     uint64
+	mu      sync.Mutex // protect following
+	samples []time.Duration
+	next    int           // 下一个样本写入的位置
+	added   int           // 上次计算分位数后增加的样本数
+	delay   time.Duration // 缓存的分位数
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	if policy.Delay <= 0 {
+		policy.Delay = defaultHedgeDelay
+	}
+	return &hedger{policy: policy, samples: make([]time.Duration, 0, hedgeSamples)}
+}
+
+func (h *hedger) applies(serviceMethod string) bool {
+	return h.policy.Idempotent == nil || h.policy.Idempotent(serviceMethod)
+}
+
+// record 记录一次成功调用的延迟
+func (h *hedger) record(latency time.Duration) {
+	if h.policy.Percentile <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+	}
+	h.next = (h.next + 1) % hedgeSamples
+	h.added++
+}
+
+// hedgeDelay 返回发送第二次调用前的等待时间
+func (h *hedger) hedgeDelay() time.Duration {
+	if h.policy.Percentile <= 0 {
+		return h.policy.Delay
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < minHedgeSamples {
+		return h.policy.Delay
+	}
+	if h.delay == 0 || h.added >= hedgeRecompute {
+		sorted := make([]time.Duration, len(h.samples))
+		copy(sorted, h.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(float64(len(sorted)) * h.policy.Percentile)
+		if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+		h.delay = sorted[i]
+		h.added = 0
+	}
+	return h.delay
+}
+
+func (h *hedger) stats() HedgeStats {
+	return HedgeStats{
+		Calls:  atomic.LoadUint64(&h.calls),
+		Hedged: atomic.LoadUint64(&h.hedged),
+		Won:    atomic.LoadUint64(&h.won),
+		Delay:  h.hedgeDelay(),
+	}
+}
+
+// SetHedgePolicy 设置对冲请求的策略，为 nil 时不对冲。与重试策略一起使用时，见 SetRetryPolicy
+func (xc *XClient) SetHedgePolicy(policy *HedgePolicy) {
+	xc.emu.Lock()
+	defer xc.emu.Unlock()
+	if policy == nil {
+		xc.hedger = nil
+		return
+	}
+	xc.hedger = newHedger(*policy)
+}
+
+func (xc *XClient) hedgerFor(serviceMethod string) *hedger {
+	xc.emu.Lock()
+	defer xc.emu.Unlock()
+	if xc.hedger == nil || !xc.hedger.applies(serviceMethod) {
+		return nil
+	}
+	return xc.hedger
+}
+
+// HedgeStats 返回对冲请求的统计
+func (xc *XClient) HedgeStats() HedgeStats {
+	xc.emu.Lock()
+	h := xc.hedger
+	xc.emu.Unlock()
+	if h == nil {
+		return HedgeStats{}
+	}
+	return h.stats()
+}
+
+type hedgeResult struct {
+	reply  interface{}
+	err    error
+	hedged bool // 是否是第二次调用的结果
+}
+
+// callHedged 先调用 rpcAddr，等待一段时间没有返回时再调用另一个服务，
+// 返回先成功的结果并取消另一个调用；两次都失败时返回最后一个错误
+func (xc *XClient) callHedged(ctx context.Context, h *hedger, rpcAddr string, serviceMethod string, args, reply interface{}) error {
+	atomic.AddUint64(&h.calls, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 返回时取消还没有完成的调用
+	results := make(chan hedgeResult, 2)
+	attempt := func(addr string, hedged bool) {
+		cloned := cloneReply(reply)
+		start := time.Now()
+		err := xc.call(addr, ctx, serviceMethod, args, cloned)
+		if err == nil {
+			h.record(time.Since(start))
+		}
+		results <- hedgeResult{reply: cloned, err: err, hedged: hedged}
+	}
+	go attempt(rpcAddr, false)
+
+	pending := 1
+	timer := time.NewTimer(h.hedgeDelay())
+	defer timer.Stop()
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			next, e := xc.selectOther(ctx, serviceMethod, args, map[string]bool{rpcAddr: true})
+			if e != nil || next == rpcAddr {
+				continue
+			}
+			atomic.AddUint64(&h.hedged, 1)
+			pending++
+			go attempt(next, true)
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				err = r.err
+				continue
+			}
+			if r.hedged {
+				atomic.AddUint64(&h.won, 1)
+			}
+			setReply(reply, r.reply)
+			return nil
+		}
+	}
+	return err
+}
+
+// cloneReply 创建一个与 reply 类型相同的新值，并发的调用不能共用同一个 reply
+func cloneReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+}
+
+// setReply 把 cloned 的值复制到 reply
+func setReply(reply, cloned interface{}) {
+	if reply == nil {
+		return
+	}
+	reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(cloned).Elem())
+}
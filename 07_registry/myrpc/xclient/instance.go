@@ -0,0 +1,52 @@
+package xclient
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Instance 是服务发现返回的一个服务实例。服务地址可以在 ? 之后带上元数据，
+// 如 "tcp@127.0.0.1:8000?weight=3&zone=a"，XDial 建立连接时会忽略元数据
+type Instance struct {
+	Server string            // 完整的地址，包含元数据
+	Addr   string            // 不含元数据的地址，同一个实例修改元数据后 Addr 不变
+	Weight int               // 权重，默认为 1，为 0 时加权模式不会选择该实例
+	Meta   map[string]string // 所有元数据
+}
+
+const defaultWeight = 1
+
+// ParseInstance 解析服务地址中的元数据
+func ParseInstance(server string) Instance {
+	ins := Instance{
+		Server: server,
+		Addr:   server,
+		Weight: defaultWeight,
+		Meta:   make(map[string]string),
+	}
+	i := strings.Index(server, "?")
+	if i < 0 {
+		return ins
+	}
+	ins.Addr = server[:i]
+	values, err := url.ParseQuery(server[i+1:])
+	if err != nil {
+		return ins
+	}
+	for key := range values {
+		ins.Meta[key] = values.Get(key)
+	}
+	if w, err := strconv.Atoi(ins.Meta["weight"]); err == nil && w >= 0 {
+		ins.Weight = w
+	}
+	return ins
+}
+
+func parseInstances(servers []string) []Instance {
+	instances := make([]Instance, len(servers))
+	for i, server := range servers {
+		instances[i] = ParseInstance(server)
+	}
+	return instances
+}
@@ -0,0 +1,72 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"fmt"
+	"regexp"
+)
+
+var _ Collector = (*XClient)(nil)
+
+var metricsNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SetMetricsName 设置 XClient 的指标的名字，指标名为 myrpc_xclient_<name>_*，为空时为 myrpc_xclient_*。
+// 同一个进程中的多个 XClient 需要设置不同的名字才能添加到同一个指标页面
+func (xc *XClient) SetMetricsName(name string) error {
+	if name != "" && !metricsNamePattern.MatchString(name) {
+		return fmt.Errorf("rpc xclient: invalid metrics name %q", name)
+	}
+	xc.nmu.Lock()
+	defer xc.nmu.Unlock()
+	xc.metricsName = name
+	return nil
+}
+
+// WriteMetrics 输出每个服务的调用统计、连接数、健康和熔断状态，指标名见 SetMetricsName。
+// 按方法统计的调用已经由 Client 记录，见 myrpc 的 /metrics
+func (xc *XClient) WriteMetrics(w *MetricsWriter) {
+	xc.nmu.Lock()
+	prefix := "myrpc_xclient_"
+	if xc.metricsName != "" {
+		prefix += xc.metricsName + "_"
+	}
+	xc.nmu.Unlock()
+	stats := xc.ServerStats()
+	w.Family(prefix+"requests_total", "counter", "Completed calls by server.")
+	for _, s := range stats {
+		w.Sample(prefix+"requests_total", float64(s.Requests), "addr", s.Addr)
+	}
+	w.Family(prefix+"failures_total", "counter", "Failed calls by server, excluding server errors.")
+	for _, s := range stats {
+		w.Sample(prefix+"failures_total", float64(s.Failures), "addr", s.Addr)
+	}
+	w.Family(prefix+"inflight_requests", "gauge", "Calls in progress by server.")
+	for _, s := range stats {
+		w.Sample(prefix+"inflight_requests", float64(s.Inflight), "addr", s.Addr)
+	}
+	w.Family(prefix+"latency_seconds", "gauge", "Exponentially weighted average latency by server.")
+	for _, s := range stats {
+		w.Sample(prefix+"latency_seconds", s.Latency.Seconds(), "addr", s.Addr)
+	}
+	pools := xc.PoolStats()
+	w.Family(prefix+"open_connections", "gauge", "Pooled connections by server.")
+	for _, p := range pools {
+		w.Sample(prefix+"open_connections", float64(p.Conns), "addr", p.Addr)
+	}
+	w.Family(prefix+"server_available", "gauge", "Whether the server passed health checks and is not ejected.")
+	for _, h := range xc.HealthStats() {
+		available := 0.0
+		if h.Healthy && !h.Ejected {
+			available = 1
+		}
+		w.Sample(prefix+"server_available", available, "addr", h.Addr)
+	}
+	w.Family(prefix+"breaker_open", "gauge", "Whether the circuit breaker of the server is open.")
+	for _, b := range xc.BreakerStats() {
+		open := 0.0
+		if b.State == BreakerOpen {
+			open = 1
+		}
+		w.Sample(prefix+"breaker_open", open, "addr", b.Addr)
+	}
+}
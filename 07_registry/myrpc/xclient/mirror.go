@@ -0,0 +1,354 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorPolicy 是流量复制的策略：按比例把调用复制一份发给影子服务，丢弃影子服务的结果，
+// 只与生产服务的结果比较。影子调用在生产调用返回后异步发出，不影响调用的延迟；
+// args 和 reply 在 Call 返回前通过 gob 深复制，调用方之后可以修改或复用它们。
+// 影子服务可以来自单独的 Discovery，也可以按元数据从 XClient 的服务中选出，
+// 此时需要用路由规则把影子服务排除在生产流量之外。
+// 影子调用使用单独的连接，不经过熔断、重试和调用统计，也不会被 XClient 的连接清理关闭
+type MirrorPolicy struct {
+	Discovery     Discovery                       // 影子服务的服务发现，为 nil 时使用 XClient 的服务发现
+	Shadow        map[string]string               // 影子服务的元数据需要包含的键值，如 {"version": "v2"}，Discovery 为 nil 时不能为空
+	Percent       float64                         // 复制的比例，0~100，为 0 时为 100
+	Methods       func(serviceMethod string) bool // 判断方法是否复制，为 nil 时复制所有方法
+	Timeout       time.Duration                   // 影子调用的超时时间
+	MaxConcurrent int                             // 同时进行的影子调用数的上限，超过时不再复制
+	MaxDiffs      int                             // 报告中保留的最近的不同结果的数量
+}
+
+const (
+	defaultMirrorTimeout       = time.Second
+	defaultMirrorMaxConcurrent = 100
+	defaultMirrorMaxDiffs      = 20
+)
+
+var errNoShadow = errors.New("rpc xclient: mirror policy without Discovery needs Shadow metadata")
+
+// MirrorShadowKey 是影子调用的请求元数据中的键，值为 "true"，服务端可以据此识别影子流量
+const MirrorShadowKey = "x-myrpc-shadow"
+
+// MirrorDiff 是一次结果不同的影子调用
+type MirrorDiff struct {
+	ServiceMethod string
+	Server        string // 影子服务
+	Production    string // 生产服务的结果或错误
+	Shadow        string // 影子服务的结果或错误
+	Time          time.Time
+}
+
+// MirrorReport 是流量复制的报告
+type MirrorReport struct {
+	Mirrored  uint64       // 发出的影子调用数
+	Equal     uint64       // 结果相同的次数
+	Different uint64       // 结果不同的次数
+	Errors    uint64       // 影子调用失败的次数
+	Skipped   uint64       // 生产调用失败，无法比较的次数
+	Dropped   uint64       // 影子调用太多而没有复制的次数
+	Diffs     []MirrorDiff // 最近的不同结果，从旧到新
+}
+
+// mirror 执行流量复制并记录比较的结果
+type mirror struct {
+	policy    MirrorPolicy
+	sem       chan struct{} // 限制同时进行的影子调用数
+	mirrored  uint64
+	equal     uint64
+	different uint64
+	errors    uint64
+	skipped   uint64
+	dropped   uint64
+	mu        sync.Mutex // protect diffs
+	diffs     []MirrorDiff
+	cmu       sync.Mutex         // protect following
+	clients   map[string]*Client // 到影子服务的连接，以不含元数据的地址为键
+	closed    bool
+}
+
+// SetMirrorPolicy 开始按 policy 复制流量，为 nil 时停止复制。
+// policy 没有设置 Discovery 时 Shadow 不能为空，否则影子调用会发给生产服务
+func (xc *XClient) SetMirrorPolicy(policy *MirrorPolicy) error {
+	if policy != nil && policy.Discovery == nil && len(policy.Shadow) == 0 {
+		return errNoShadow
+	}
+	xc.mmu.Lock()
+	defer xc.mmu.Unlock()
+	if xc.mirror != nil {
+		xc.mirror.close()
+		xc.mirror = nil
+	}
+	if policy == nil {
+		return nil
+	}
+	p := *policy
+	if p.Timeout <= 0 {
+		p.Timeout = defaultMirrorTimeout
+	}
+	if p.MaxConcurrent <= 0 {
+		p.MaxConcurrent = defaultMirrorMaxConcurrent
+	}
+	if p.MaxDiffs <= 0 {
+		p.MaxDiffs = defaultMirrorMaxDiffs
+	}
+	xc.mirror = &mirror{policy: p, sem: make(chan struct{}, p.MaxConcurrent), clients: make(map[string]*Client)}
+	return nil
+}
+
+// mirrorFor 返回需要复制这次调用时的 mirror
+func (xc *XClient) mirrorFor(serviceMethod string) *mirror {
+	xc.mmu.Lock()
+	m := xc.mirror
+	xc.mmu.Unlock()
+	if m == nil || (m.policy.Methods != nil && !m.policy.Methods(serviceMethod)) {
+		return nil
+	}
+	if m.policy.Percent > 0 && m.policy.Percent < 100 && rand.Float64()*100 >= m.policy.Percent {
+		return nil
+	}
+	return m
+}
+
+// MirrorReport 返回流量复制的报告
+func (xc *XClient) MirrorReport() MirrorReport {
+	xc.mmu.Lock()
+	m := xc.mirror
+	xc.mmu.Unlock()
+	if m == nil {
+		return MirrorReport{}
+	}
+	m.mu.Lock()
+	diffs := append([]MirrorDiff(nil), m.diffs...)
+	m.mu.Unlock()
+	return MirrorReport{
+		Mirrored:  atomic.LoadUint64(&m.mirrored),
+		Equal:     atomic.LoadUint64(&m.equal),
+		Different: atomic.LoadUint64(&m.different),
+		Errors:    atomic.LoadUint64(&m.errors),
+		Skipped:   atomic.LoadUint64(&m.skipped),
+		Dropped:   atomic.LoadUint64(&m.dropped),
+		Diffs:     diffs,
+	}
+}
+
+// shadowServer 从影子服务中随机选择一个
+func (m *mirror) shadowServer(xc *XClient) (string, error) {
+	d := m.policy.Discovery
+	if d == nil {
+		d = xc.discovery
+	}
+	servers, err := d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	var shadows []string
+	for _, server := range servers {
+		meta := ParseInstance(server).Meta
+		matched := true
+		for k, v := range m.policy.Shadow {
+			if meta[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			shadows = append(shadows, server)
+		}
+	}
+	m.prune(shadows)
+	if len(shadows) == 0 {
+		return "", errNoServers
+	}
+	return shadows[rand.Intn(len(shadows))], nil
+}
+
+// client 返回到影子服务 server 的连接，没有可用的连接时建立
+func (m *mirror) client(xc *XClient, ctx context.Context, server string) (*Client, error) {
+	addr := ParseInstance(server).Addr
+	m.cmu.Lock()
+	client, ok := m.clients[addr]
+	if ok && !client.IsAvailable() {
+		_ = client.Close()
+		delete(m.clients, addr)
+		ok = false
+	}
+	m.cmu.Unlock()
+	if ok {
+		return client, nil
+	}
+	client, err := xc.dialContext(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	if m.closed {
+		_ = client.Close()
+		return nil, ErrShutdown
+	}
+	if c, ok := m.clients[addr]; ok {
+		// 其他影子调用已经建立了连接
+		_ = client.Close()
+		return c, nil
+	}
+	m.clients[addr] = client
+	return client, nil
+}
+
+// prune 关闭到已经不是影子服务的连接
+func (m *mirror) prune(shadows []string) {
+	alive := make(map[string]bool, len(shadows))
+	for _, server := range shadows {
+		alive[ParseInstance(server).Addr] = true
+	}
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	for addr, client := range m.clients {
+		if !alive[addr] {
+			_ = client.Close()
+			delete(m.clients, addr)
+		}
+	}
+}
+
+// close 关闭到影子服务的所有连接，之后建立的连接直接关闭
+func (m *mirror) close() {
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	m.closed = true
+	for addr, client := range m.clients {
+		_ = client.Close()
+		delete(m.clients, addr)
+	}
+}
+
+// shadow 在后台把调用发给影子服务，并与生产服务的结果 reply、err 比较
+func (m *mirror) shadow(xc *XClient, ctx context.Context, serviceMethod string, args, reply interface{}, err error) {
+	var serverErr ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		atomic.AddUint64(&m.skipped, 1)
+		return
+	}
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+	// 调用方在返回后可能修改或复用 args 和 reply，返回前先深复制一份
+	shadowArgs, e := deepCopy(args)
+	if e != nil {
+		<-m.sem
+		atomic.AddUint64(&m.errors, 1)
+		return
+	}
+	production := cloneReply(reply)
+	if err == nil {
+		if production, e = deepCopy(reply); e != nil {
+			<-m.sem
+			atomic.AddUint64(&m.errors, 1)
+			return
+		}
+	}
+	md := WithMetadata(context.Background(), Metadata(ctx))
+	md = WithMetadata(md, map[string]string{MirrorShadowKey: "true"})
+	go func() {
+		defer func() { <-m.sem }()
+		server, e := m.shadowServer(xc)
+		if e != nil {
+			atomic.AddUint64(&m.errors, 1)
+			return
+		}
+		atomic.AddUint64(&m.mirrored, 1)
+		shadowCtx, cancel := context.WithTimeout(md, m.policy.Timeout)
+		defer cancel()
+		shadowReply := cloneReply(reply)
+		client, e := m.client(xc, shadowCtx, server)
+		if e == nil {
+			e = client.Call(shadowCtx, serviceMethod, shadowArgs, shadowReply)
+		}
+		m.compare(serviceMethod, server, production, err, shadowReply, e)
+	}()
+}
+
+// compare 比较生产服务和影子服务的结果。服务端返回的错误也参与比较，其他错误算作影子调用失败
+func (m *mirror) compare(serviceMethod, server string, production interface{}, prodErr error, shadow interface{}, shadowErr error) {
+	var serverErr ServerError
+	if shadowErr != nil && !errors.As(shadowErr, &serverErr) {
+		atomic.AddUint64(&m.errors, 1)
+		return
+	}
+	var equal bool
+	if prodErr != nil || shadowErr != nil {
+		equal = prodErr != nil && shadowErr != nil && prodErr.Error() == shadowErr.Error()
+	} else {
+		equal = reflect.DeepEqual(production, shadow)
+	}
+	if equal {
+		atomic.AddUint64(&m.equal, 1)
+		return
+	}
+	atomic.AddUint64(&m.different, 1)
+	diff := MirrorDiff{
+		ServiceMethod: serviceMethod,
+		Server:        server,
+		Production:    describeResult(production, prodErr),
+		Shadow:        describeResult(shadow, shadowErr),
+		Time:          time.Now(),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diffs = append(m.diffs, diff)
+	if len(m.diffs) > m.policy.MaxDiffs {
+		m.diffs = m.diffs[len(m.diffs)-m.policy.MaxDiffs:]
+	}
+}
+
+// deepCopy 通过 gob 编码再解码复制 v，v 为指针时返回指向副本的指针
+func deepCopy(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	val := reflect.ValueOf(v)
+	ptr := val.Kind() == reflect.Ptr
+	if ptr {
+		if val.IsNil() {
+			return v, nil
+		}
+		val = val.Elem()
+	}
+	var buf bytes.Buffer
+	out := reflect.New(val.Type())
+	if err := gob.NewEncoder(&buf).Encode(val.Interface()); err != nil {
+		return nil, err
+	}
+	if err := gob.NewDecoder(&buf).Decode(out.Interface()); err != nil {
+		return nil, err
+	}
+	if ptr {
+		return out.Interface(), nil
+	}
+	return out.Elem().Interface(), nil
+}
+
+func describeResult(reply interface{}, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if reply == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", reflect.ValueOf(reply).Elem().Interface())
+}
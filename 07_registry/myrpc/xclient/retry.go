@@ -0,0 +1,227 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// FailMode 调用失败后的处理方式
+type FailMode int
+
+const (
+	FailFast FailMode = iota // 直接返回错误
+	Failover                 // 换一个服务重试
+	Failtry                  // 在同一个服务上重试
+)
+
+// RetryPolicy 是 XClient 的重试策略
+type RetryPolicy struct {
+	Mode        FailMode
+	MaxRetries  int                  // 最多重试的次数，不含第一次调用
+	BaseBackoff time.Duration        // 第一次重试前的等待时间，之后每次翻倍
+	MaxBackoff  time.Duration        // 等待时间的上限
+	BudgetRatio float64              // 重试预算：每次调用可以积累的重试次数，0.1 表示重试最多占调用的 10%
+	MinBudget   float64              // 预算的初始值和上限的下限，保证调用量少时也能重试
+	Retryable   func(err error) bool // 判断错误是否可以重试，默认为 IsRetryable
+	// 判断方法是否幂等。幂等的方法在请求可能已经发出时（如连接断开）也会重试，为 nil 时所有方法都不幂等
+	Idempotent func(serviceMethod string) bool
+}
+
+const (
+	defaultMaxRetries  = 2
+	defaultBaseBackoff = time.Millisecond * 10
+	defaultMaxBackoff  = time.Second
+	defaultBudgetRatio = 0.2
+	defaultMinBudget   = 10
+)
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = defaultMaxRetries
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = defaultBaseBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.BudgetRatio <= 0 {
+		p.BudgetRatio = defaultBudgetRatio
+	}
+	if p.MinBudget <= 0 {
+		p.MinBudget = defaultMinBudget
+	}
+	if p.Retryable == nil {
+		p.Retryable = IsRetryable
+	}
+	return p
+}
+
+// dialError 是建立连接时的错误，此时请求一定没有发出
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
+// IsRetryable 判断一次调用的错误是否可以安全地重试：只有连接失败和熔断，此时请求一定没有发出。
+// 连接断开等错误发生时服务端可能已经处理了请求，只对 RetryPolicy.Idempotent 的方法重试
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var de *dialError
+	return errors.As(err, &de) || errors.Is(err, ErrCircuitOpen)
+}
+
+// isTransportError 判断错误是否来自传输层，此时请求可能已经发出，但没有收到响应。
+// 服务端返回的错误和调用方的 context 结束不属于此类
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var serverErr ServerError
+	if errors.As(err, &serverErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryable 判断 serviceMethod 的调用在 err 之后是否可以重试
+func (p *RetryPolicy) retryable(serviceMethod string, err error) bool {
+	if p.Retryable(err) {
+		return true
+	}
+	return p.Idempotent != nil && p.Idempotent(serviceMethod) && isTransportError(err)
+}
+
+// retryBudget 限制重试占调用的比例，避免服务整体故障时重试放大流量
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	max    float64
+}
+
+func newRetryBudget(ratio, min float64) *retryBudget {
+	return &retryBudget{tokens: min, ratio: ratio, max: min}
+}
+
+// deposit 每次调用积累 ratio 个重试机会
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// withdraw 消耗一个重试机会，没有时返回 false
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// SetRetryPolicy 设置调用失败后的重试策略，为 nil 时不重试。
+// 同时设置了对冲策略时，对冲调用整体失败后才重试
+func (xc *XClient) SetRetryPolicy(policy *RetryPolicy) {
+	xc.rmu.Lock()
+	defer xc.rmu.Unlock()
+	if policy == nil {
+		xc.retry = nil
+		xc.budget = nil
+		return
+	}
+	p := policy.withDefaults()
+	xc.retry = &p
+	xc.budget = newRetryBudget(p.BudgetRatio, p.MinBudget)
+}
+
+func (xc *XClient) retryPolicy() (*RetryPolicy, *retryBudget) {
+	xc.rmu.Lock()
+	defer xc.rmu.Unlock()
+	return xc.retry, xc.budget
+}
+
+// callWithRetry 按重试策略调用，rpcAddr 为第一次调用的服务。h 不为 nil 时每一次调用都按对冲策略进行
+func (xc *XClient) callWithRetry(ctx context.Context, policy *RetryPolicy, budget *retryBudget, h *hedger,
+	rpcAddr string, serviceMethod string, args, reply interface{}) error {
+	budget.deposit()
+	tried := map[string]bool{rpcAddr: true}
+	err := xc.attempt(ctx, h, rpcAddr, serviceMethod, args, reply)
+	for n := 1; n <= policy.MaxRetries && policy.retryable(serviceMethod, err); n++ {
+		wait := Backoff(policy.BaseBackoff, policy.MaxBackoff, n)
+		// 等待之后已经超过调用方的截止时间，不再重试
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			break
+		}
+		if !budget.withdraw() {
+			break
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		if policy.Mode == Failover {
+			if next, e := xc.selectOther(ctx, serviceMethod, args, tried); e == nil {
+				rpcAddr = next
+			}
+			tried[rpcAddr] = true
+		}
+		err = xc.attempt(ctx, h, rpcAddr, serviceMethod, args, reply)
+	}
+	return err
+}
+
+// selectOther 按负载均衡模式选择一个还没有尝试过的服务，都尝试过时允许重复
+func (xc *XClient) selectOther(ctx context.Context, serviceMethod string, args interface{}, tried map[string]bool) (string, error) {
+	var server string
+	var err error
+	for i := 0; i < 3; i++ {
+		if server, err = xc.selectServer(ctx, serviceMethod, args); err != nil || !tried[server] {
+			return server, err
+		}
+	}
+	servers, err := xc.availableServers()
+	if err != nil {
+		return "", err
+	}
+	var untried []string
+	for _, s := range servers {
+		if !tried[s] {
+			untried = append(untried, s)
+		}
+	}
+	if len(untried) == 0 {
+		return server, nil
+	}
+	return untried[rand.Intn(len(untried))], nil
+}
@@ -0,0 +1,275 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// Rule 是一条路由规则。调用的方法和请求元数据都匹配时，按 Percent 的比例把调用路由到
+// 元数据包含 Route 的服务上，如把 5% 的 Foo.* 调用发到 version=v2 的服务，
+// 或把元数据中 x-canary=true 的调用发到 canary 服务。规则按顺序匹配，第一条生效的规则决定候选的服务；
+// 没有规则生效时在所有服务中选择，需要把新版本排除在默认流量之外时，可以在最后加一条匹配所有调用的规则
+type Rule struct {
+	Name     string            `json:"name"`
+	Service  string            `json:"service"`  // 匹配的方法，支持 path.Match 的通配符，如 "Foo.*"；为空时匹配所有方法
+	Match    map[string]string `json:"match"`    // 请求元数据需要包含的键值，见 myrpc.WithMetadata
+	Percent  float64           `json:"percent"`  // 匹配的调用中被路由的比例，0~100，为 0 时为 100
+	Route    map[string]string `json:"route"`    // 目标服务的元数据需要包含的键值，如 {"version": "v2"}
+	Fallback bool              `json:"fallback"` // 没有符合 Route 的可用服务时继续匹配下一条规则，否则返回错误
+}
+
+// ErrNoRouteServers 生效的路由规则没有选出可用的服务
+var ErrNoRouteServers = errors.New("rpc xclient: no available servers for routing rule")
+
+// validate 检查规则的格式
+func (r *Rule) validate() error {
+	if _, err := path.Match(r.Service, ""); err != nil {
+		return fmt.Errorf("rpc xclient: rule %q: invalid service pattern %q: %v", r.Name, r.Service, err)
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("rpc xclient: rule %q: percent %v out of range", r.Name, r.Percent)
+	}
+	return nil
+}
+
+// matches 判断规则是否匹配调用的方法和元数据
+func (r *Rule) matches(serviceMethod string, md map[string]string) bool {
+	if r.Service != "" {
+		if ok, _ := path.Match(r.Service, serviceMethod); !ok {
+			return false
+		}
+	}
+	for k, v := range r.Match {
+		if md[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sampled 按 Percent 判断调用是否被路由。ctx 中有路由 key 时按 key 哈希，相同 key 的结果不变
+func (r *Rule) sampled(ctx context.Context) bool {
+	if r.Percent == 0 || r.Percent >= 100 {
+		return true
+	}
+	if key, ok := RoutingKey(ctx); ok {
+		return float64(hashKey(r.Name+"#"+key)%10000) < r.Percent*100
+	}
+	return rand.Float64()*100 < r.Percent
+}
+
+// routes 判断服务的元数据是否包含 Route
+func (r *Rule) routes(server string) bool {
+	meta := ParseInstance(server).Meta
+	for k, v := range r.Route {
+		if meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleSet 是一组生效的路由规则，替换规则时整体替换
+type ruleSet struct {
+	rules   []Rule
+	mu      sync.Mutex                     // protect following
+	subsets map[int]*MultiServersDiscovery // 每条规则选出的服务，用于在其中按 discovery 的模式选择
+}
+
+// match 返回第一条生效的规则的位置及其选出的服务，没有规则生效时返回 -1
+func (rs *ruleSet) match(ctx context.Context, serviceMethod string, servers []string) (int, []string, error) {
+	md := Metadata(ctx)
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if !r.matches(serviceMethod, md) || !r.sampled(ctx) {
+			continue
+		}
+		var subset []string
+		for _, server := range servers {
+			if r.routes(server) {
+				subset = append(subset, server)
+			}
+		}
+		if len(subset) > 0 {
+			return i, subset, nil
+		}
+		if !r.Fallback {
+			return i, nil, fmt.Errorf("%w: %s", ErrNoRouteServers, r.Name)
+		}
+	}
+	return -1, nil, nil
+}
+
+// subset 返回第 i 条规则的服务发现，服务列表变化时更新
+func (rs *ruleSet) subset(i int, servers []string) *MultiServersDiscovery {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	d, ok := rs.subsets[i]
+	if !ok {
+		d = NewMultiServerDiscovery(servers)
+		rs.subsets[i] = d
+		return d
+	}
+	if current, _ := d.GetAll(); !equalServers(current, servers) {
+		_ = d.Update(servers)
+	}
+	return d
+}
+
+// SetRules 替换路由规则，正在进行的调用不受影响；为空时不使用路由规则
+func (xc *XClient) SetRules(rules []Rule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	var rs *ruleSet
+	if len(rules) > 0 {
+		rs = &ruleSet{rules: append([]Rule(nil), rules...), subsets: make(map[int]*MultiServersDiscovery)}
+	}
+	xc.rules.Store(rs)
+	return nil
+}
+
+// Rules 返回当前的路由规则
+func (xc *XClient) Rules() []Rule {
+	rs := xc.ruleSet()
+	if rs == nil {
+		return nil
+	}
+	return append([]Rule(nil), rs.rules...)
+}
+
+func (xc *XClient) ruleSet() *ruleSet {
+	rs, _ := xc.rules.Load().(*ruleSet)
+	return rs
+}
+
+// route 按路由规则从 servers 中选出候选的服务，没有规则生效时返回 servers
+func (xc *XClient) route(ctx context.Context, serviceMethod string, servers []string) ([]string, error) {
+	rs := xc.ruleSet()
+	if rs == nil {
+		return servers, nil
+	}
+	i, subset, err := rs.match(ctx, serviceMethod, servers)
+	if err != nil || i < 0 {
+		return servers, err
+	}
+	return subset, nil
+}
+
+// routeDiscovery 返回生效的路由规则选出的服务构成的服务发现，没有规则生效时返回 nil
+func (xc *XClient) routeDiscovery(ctx context.Context, serviceMethod string) (*MultiServersDiscovery, error) {
+	rs := xc.ruleSet()
+	if rs == nil {
+		return nil, nil
+	}
+	servers, err := xc.availableServers()
+	if err != nil {
+		return nil, err
+	}
+	i, subset, err := rs.match(ctx, serviceMethod, servers)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	return rs.subset(i, subset), nil
+}
+
+// RuleSource 读取路由规则，如 FileRules、RegistryRules
+type RuleSource func() ([]Rule, error)
+
+// ParseRules 解析 JSON 数组形式的路由规则
+func ParseRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("rpc xclient: parse rules: %v", err)
+	}
+	return rules, nil
+}
+
+// FileRules 从文件读取路由规则
+func FileRules(filename string) RuleSource {
+	return func() ([]Rule, error) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return ParseRules(data)
+	}
+}
+
+// RegistryRules 从注册中心的 /rules 读取路由规则，registry 为注册中心的地址
+func RegistryRules(registry string) RuleSource {
+	return func() ([]Rule, error) {
+		resp, err := registryClient.Get(registry + "/rules")
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return ParseRules(data)
+	}
+}
+
+// LoadRules 从 src 读取并替换路由规则
+func (xc *XClient) LoadRules(src RuleSource) error {
+	rules, err := src()
+	if err != nil {
+		return err
+	}
+	return xc.SetRules(rules)
+}
+
+// WatchRules 每隔 interval 从 src 重新读取路由规则，直到 Close；读取失败时保留当前的规则。
+// 再次调用时替换之前的 src
+func (xc *XClient) WatchRules(src RuleSource, interval time.Duration) {
+	stop := make(chan struct{})
+	xc.wmu.Lock()
+	if xc.stopRules != nil {
+		close(xc.stopRules)
+	}
+	xc.stopRules = stop
+	xc.wmu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := xc.LoadRules(src); err != nil {
+				xc.logger.Warnf("rpc xclient: load rules err: %v", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// equalServers 判断两个服务列表是否相同
+func equalServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
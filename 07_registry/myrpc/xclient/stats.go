@@ -0,0 +1,140 @@
+package xclient
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 延迟的衰减时间常数：一个样本的权重每过 decayTime 衰减为原来的 1/e
+const decayTime = time.Second * 10
+
+// serverStats 记录 XClient 对一个服务的调用情况
+type serverStats struct {
+	inflight int64  // 正在进行的调用数
+	requests uint64 // 完成的调用数
+	failures uint64 // 失败的调用数，不含服务端返回的错误
+	mu       sync.Mutex
+	ewma     float64   // 延迟的指数加权移动平均，单位为纳秒
+	last     time.Time // 上一个样本的时间
+}
+
+// ServerStat 是一个服务的调用情况的快照
+type ServerStat struct {
+	Addr     string        // 不含元数据的服务地址
+	Inflight int64         // 正在进行的调用数
+	Latency  time.Duration // 平均延迟（指数加权）
+	Requests uint64        // 完成的调用数
+	Failures uint64        // 失败的调用数
+}
+
+func (s *serverStats) begin() {
+	atomic.AddInt64(&s.inflight, 1)
+}
+
+// end 结束一次调用，并把延迟计入平均值。样本的权重随时间衰减，
+// 调用稀疏时旧的样本很快失去影响
+func (s *serverStats) end(latency time.Duration, failed bool) {
+	atomic.AddInt64(&s.inflight, -1)
+	atomic.AddUint64(&s.requests, 1)
+	if failed {
+		atomic.AddUint64(&s.failures, 1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.last.IsZero() {
+		s.ewma = float64(latency)
+	} else {
+		w := math.Exp(-float64(now.Sub(s.last)) / float64(decayTime))
+		s.ewma = s.ewma*w + float64(latency)*(1-w)
+	}
+	s.last = now
+}
+
+func (s *serverStats) pending() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+func (s *serverStats) latency() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ewma
+}
+
+// cost 估计把一个新请求发给该服务的代价：平均延迟 * (正在进行的调用数 + 1)。
+// 还没有延迟样本的服务代价为 0，会优先被尝试
+func (s *serverStats) cost() float64 {
+	return s.latency() * float64(s.pending()+1)
+}
+
+// statsFor 返回 server 的调用统计，以不含元数据的地址为键
+func (xc *XClient) statsFor(server string) *serverStats {
+	addr := ParseInstance(server).Addr
+	xc.smu.Lock()
+	defer xc.smu.Unlock()
+	s, ok := xc.stats[addr]
+	if !ok {
+		s = new(serverStats)
+		xc.stats[addr] = s
+	}
+	return s
+}
+
+// ServerStats 返回每个调用过的服务的统计，按地址排序
+func (xc *XClient) ServerStats() []ServerStat {
+	xc.smu.Lock()
+	defer xc.smu.Unlock()
+	stats := make([]ServerStat, 0, len(xc.stats))
+	for addr, s := range xc.stats {
+		stats = append(stats, ServerStat{
+			Addr:     addr,
+			Inflight: s.pending(),
+			Latency:  time.Duration(s.latency()),
+			Requests: atomic.LoadUint64(&s.requests),
+			Failures: atomic.LoadUint64(&s.failures),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// leastPendingSelect 在 servers 中选择正在进行的调用数最少的服务，数量相同时随机选择
+func (xc *XClient) leastPendingSelect(servers []string) (string, error) {
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	offset := rand.Intn(len(servers))
+	best, fewest := "", int64(math.MaxInt64)
+	for i := range servers {
+		server := servers[(offset+i)%len(servers)]
+		if p := xc.statsFor(server).pending(); p < fewest {
+			best, fewest = server, p
+		}
+	}
+	return best, nil
+}
+
+// p2cSelect 在 servers 中随机选出两个服务，选择其中代价较小的一个（power of two choices）。
+// 比总是选择最优的服务更不容易让所有客户端同时涌向同一个服务
+func (xc *XClient) p2cSelect(servers []string) (string, error) {
+	switch len(servers) {
+	case 0:
+		return "", errNoServers
+	case 1:
+		return servers[0], nil
+	}
+	i := rand.Intn(len(servers))
+	j := rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := servers[i], servers[j]
+	if xc.statsFor(b).cost() < xc.statsFor(a).cost() {
+		return b, nil
+	}
+	return a, nil
+}
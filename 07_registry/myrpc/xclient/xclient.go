@@ -4,8 +4,10 @@ import (
 	. "MyRpc/07_registry/myrpc"
 	"context"
 	"io"
-	"reflect"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type XClient struct {
@@ -13,133 +15,283 @@ type XClient struct {
 	mode 		SelectMode // 负载均衡模式
 	opt    		*Option // 协议选项
 	mu    		sync.Mutex // protect following
-	clients 	map[string]*Client //复用已经创建好的 Socket 连接，保存创建成功的 Client 实例
+	clients 	map[string]*connPool //复用已经创建好的 Socket 连接，以不含元数据的地址为键
+	draining	[]*connPool // 已经下线的服务的连接池，连接在调用结束后关闭
+	dials		map[string]*dialState // 建立连接失败的服务，用于退避
+	connPolicy	ConnPolicy // 管理连接的策略
+	stopClean	chan struct{} // 停止后台清理连接
+	hmu			sync.Mutex // protect following
+	keyFunc		KeyFunc // 一致性哈希模式下计算路由key
+	ring		*hashRing // 一致性哈希环，服务列表变化时重建
+	smu			sync.Mutex // protect stats
+	stats		map[string]*serverStats // 每个服务的调用统计，以不含元数据的地址为键
+	rmu			sync.Mutex // protect following
+	retry		*RetryPolicy // 重试策略，为nil时不重试
+	budget		*retryBudget // 重试预算
+	emu			sync.Mutex // protect following
+	hedger		*hedger // 对冲请求，为nil时不对冲
+	bmu			sync.Mutex // protect following
+	breakerPolicy	*BreakerPolicy // 熔断策略，为nil时不熔断
+	breakers	map[string]*breaker // 每个服务的熔断器，以不含元数据的地址为键
+	omu			sync.Mutex // protect following
+	health		map[string]*serverHealth // 每个服务的健康检查和离群检测状态，以不含元数据的地址为键
+	stopHealth	chan struct{} // 停止健康检查，没有启用时为nil
+	stopOutlier	chan struct{} // 停止离群检测，没有启用时为nil
+	zmu			sync.Mutex // protect following
+	zone		*zoneRouter // 按可用区路由的策略，为nil时ZoneAwareSelect与P2CSelect相同
+	rules		atomic.Value // 路由规则，类型为*ruleSet，可以在调用时整体替换
+	wmu			sync.Mutex // protect following
+	stopRules	chan struct{} // 停止重新读取路由规则，没有启用时为nil
+	mmu			sync.Mutex // protect following
+	mirror		*mirror // 流量复制，为nil时不复制
+	amu			sync.Mutex // protect following
+	affinity	*affinityTable // 会话与服务的绑定关系
+	nmu			sync.Mutex // protect following
+	metricsName	string // 指标的名字，见 SetMetricsName
+	logger		LoggerHolder // 日志，见 SetLogger
 }
 
 var _ io.Closer = (*XClient)(nil)
 
 func NewXClient(discovery Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{
+	xc := &XClient{
 		discovery: discovery,
 		mode: mode,
 		opt: opt,
-		clients: make(map[string]*Client),
+		clients: make(map[string]*connPool),
+		dials: make(map[string]*dialState),
+		stats: make(map[string]*serverStats),
+		breakers: make(map[string]*breaker),
+		health: make(map[string]*serverHealth),
+		affinity: newAffinityTable(AffinityPolicy{}),
+	}
+	xc.SetConnPolicy(nil)
+	return xc
+}
+
+// SetLogger 设置 XClient 的日志，为 nil 时使用 DefaultLogger。discovery 实现了 SetLogger 时一并设置。
+// 到服务的连接使用 Option.Logger
+func (xc *XClient) SetLogger(l Logger) {
+	xc.logger.Store(l)
+	if d, ok := xc.discovery.(interface{ SetLogger(Logger) }); ok {
+		d.SetLogger(l)
 	}
 }
 
 func (xc *XClient) Close() error {
+	xc.SetHealthCheck(nil)
+	xc.SetOutlierPolicy(nil)
+	xc.wmu.Lock()
+	if xc.stopRules != nil {
+		close(xc.stopRules)
+		xc.stopRules = nil
+	}
+	xc.wmu.Unlock()
+	xc.mmu.Lock()
+	if xc.mirror != nil {
+		xc.mirror.close()
+	}
+	xc.mmu.Unlock()
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	for key, client := range xc.clients {
-		_ = client.Close()
+	xc.stopCleanLocked()
+	for key, pool := range xc.clients {
+		pool.close()
 		delete(xc.clients, key)
 	}
+	for _, pool := range xc.draining {
+		pool.close()
+	}
+	xc.draining = nil
 	return nil
 }
 
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
-	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	client, ok := xc.clients[rpcAddr]
-	if ok && !client.IsAvailable() {
-		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
-	}
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	if b := xc.breakerFor(rpcAddr); b != nil {
+		generation, ok := b.allow()
+		if !ok {
+			return ErrCircuitOpen
 		}
-		xc.clients[rpcAddr] = client
+		defer func() { b.done(generation, breakerFailure(err)) }()
 	}
-	return client, nil
-}
-
-func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	client, err := xc.dial(rpcAddr)
+	conn, err := xc.dial(ctx, rpcAddr)
 	if err != nil {
-		return err
+		return &dialError{err: err}
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	defer conn.release()
+	// 记录正在进行的调用数和延迟，用于按负载选择服务
+	stats := xc.statsFor(rpcAddr)
+	stats.begin()
+	start := time.Now()
+	err = conn.Call(ctx, serviceMethod, args, reply)
+	stats.end(time.Since(start), breakerFailure(err))
+	return err
 }
 
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.discovery.Get(xc.mode)
+	err := xc.callOnce(ctx, serviceMethod, args, reply)
+	if m := xc.mirrorFor(serviceMethod); m != nil {
+		m.shadow(xc, ctx, serviceMethod, args, reply, err)
+	}
+	return err
+}
+
+// callOnce 选择服务并按对冲和重试策略完成一次调用。两者都设置时，每一次重试都是一次对冲调用
+func (xc *XClient) callOnce(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	rpcAddr, err := xc.selectServer(ctx, serviceMethod, args)
 	if err != nil {
 		return err
 	}
+	h := xc.hedgerFor(serviceMethod)
+	if policy, budget := xc.retryPolicy(); policy != nil && policy.Mode != FailFast {
+		return xc.callWithRetry(ctx, policy, budget, h, rpcAddr, serviceMethod, args, reply)
+	}
+	return xc.attempt(ctx, h, rpcAddr, serviceMethod, args, reply)
+}
+
+// attempt 调用一次 rpcAddr，h 不为 nil 时按对冲策略调用
+func (xc *XClient) attempt(ctx context.Context, h *hedger, rpcAddr string, serviceMethod string, args, reply interface{}) error {
+	if h != nil {
+		return xc.callHedged(ctx, h, rpcAddr, serviceMethod, args, reply)
+	}
 	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
-func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.discovery.GetAll()
+// selectServer 根据路由规则和负载均衡模式为一次调用选择服务。
+// 只需要服务列表的模式交给discovery，需要调用信息的模式由XClient自己完成
+func (xc *XClient) selectServer(ctx context.Context, serviceMethod string, args interface{}) (string, error) {
+	switch xc.mode {
+	case ConsistentHashSelect, LeastPendingSelect, P2CSelect, ZoneAwareSelect, SessionAffinitySelect:
+	default:
+		// 命中路由规则时，在规则选出的服务中按mode选择
+		if d, err := xc.routeDiscovery(ctx, serviceMethod); d != nil || err != nil {
+			if err != nil {
+				return "", err
+			}
+			return d.Get(xc.mode)
+		}
+		return xc.discoverySelect(xc.mode)
+	}
+	servers, err := xc.availableServers()
 	if err != nil {
-		return err
+		return "", err
 	}
-	var wg sync.WaitGroup
-	var mu sync.Mutex // protect e and replyDone
-	var e error
-	replyDone := reply == nil // if reply is nil, don't need to set value
-	ctx, cancel := context.WithCancel(ctx)
-	for _, rpcAddr := range servers {
-		wg.Add(1)
-		go func(rpcAddr string) {
-			defer wg.Done()
-			var clonedReply interface{}
-			// 若reply为nil的时候，不需要设置值
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
-			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
-			mu.Lock()
-			if err != nil && e == nil {
-				e = err
-				cancel() // if any call failed, cancel unfinished calls
-			}
-			if err == nil && !replyDone {
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
-				replyDone = true
-			}
-			mu.Unlock()
-		}(rpcAddr)
+	if servers, err = xc.route(ctx, serviceMethod, servers); err != nil {
+		return "", err
+	}
+	switch xc.mode {
+	case ConsistentHashSelect:
+		return xc.hashSelect(ctx, serviceMethod, args, servers)
+	case LeastPendingSelect:
+		return xc.leastPendingSelect(servers)
+	case P2CSelect:
+		return xc.p2cSelect(servers)
+	case SessionAffinitySelect:
+		return xc.affinitySelect(ctx, servers)
+	default:
+		return xc.zoneSelect(servers)
 	}
-	wg.Wait()
-	return e
 }
 
-func (xc *XClient) Broadcast2(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+// serverAvailable 判断服务是否可以被选择：通过了健康检查，没有被驱逐，熔断器没有打开
+func (xc *XClient) serverAvailable(server string) bool {
+	return xc.healthy(server) && xc.breakerAvailable(server)
+}
+
+// availableServers 返回可以被选择的服务。所有服务都没有通过健康检查或被驱逐时，
+// 忽略健康状态，避免检查本身的问题导致所有调用失败；熔断器打开的服务始终不会被选择
+func (xc *XClient) availableServers() ([]string, error) {
 	servers, err := xc.discovery.GetAll()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	var e error
-	replyDone := reply == nil
-	ctx, cancel := context.WithCancel(ctx)
-	for _, rpcAddr := range servers {
-		wg.Add(1)
-		go func(rpcAddr string) {
-			defer wg.Done()
-			var clonedReply interface{}
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
-			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
-			mu.Lock()
-			if err != nil && e == nil {
-				e = err
-				cancel()
-			}
-			if err == nil && !replyDone {
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
-				replyDone = true
-			}
-			mu.Unlock()
-		}(rpcAddr)
+	healthy := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if xc.healthy(server) {
+			healthy = append(healthy, server)
+		}
 	}
-	wg.Wait()
-	return e
+	if len(healthy) == 0 {
+		healthy = servers
+	}
+	available := make([]string, 0, len(healthy))
+	for _, server := range healthy {
+		if xc.breakerAvailable(server) {
+			available = append(available, server)
+		}
+	}
+	if len(available) == 0 && len(servers) > 0 {
+		return nil, ErrCircuitOpen
+	}
+	return available, nil
+}
+
+// discoverySelect 由discovery按mode选择服务，选中不可用的服务时重新选择
+func (xc *XClient) discoverySelect(mode SelectMode) (string, error) {
+	server, err := xc.discovery.Get(mode)
+	if err != nil || xc.serverAvailable(server) {
+		return server, err
+	}
+	servers, err := xc.availableServers()
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(servers); i++ {
+		if server, err = xc.discovery.Get(mode); err != nil || xc.serverAvailable(server) {
+			return server, err
+		}
+	}
+	return servers[rand.Intn(len(servers))], nil
+}
+
+// SetKeyFunc 设置一致性哈希模式下计算路由key的函数，ctx中通过WithRoutingKey指定的key优先
+func (xc *XClient) SetKeyFunc(f KeyFunc) {
+	xc.hmu.Lock()
+	defer xc.hmu.Unlock()
+	xc.keyFunc = f
+}
+
+// hashSelect 按路由key在servers构成的一致性哈希环上选择服务，没有key时随机选择
+func (xc *XClient) hashSelect(ctx context.Context, serviceMethod string, args interface{}, servers []string) (string, error) {
+	xc.hmu.Lock()
+	keyFunc := xc.keyFunc
+	xc.hmu.Unlock()
+	key, ok := RoutingKey(ctx)
+	if !ok && keyFunc != nil {
+		key, ok = keyFunc(serviceMethod, args), true
+	}
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	if !ok {
+		return servers[rand.Intn(len(servers))], nil
+	}
+	return xc.ringFor(servers).get(key), nil
+}
+
+// ringFor 返回由servers构建的一致性哈希环，服务列表没有变化时复用上一次的环
+func (xc *XClient) ringFor(servers []string) *hashRing {
+	xc.hmu.Lock()
+	defer xc.hmu.Unlock()
+	if xc.ring == nil || !xc.ring.sameServers(servers) {
+		xc.ring = newHashRing(servers, defaultReplicas)
+	}
+	return xc.ring
+}
+
+// Broadcast 调用服务发现返回的所有服务，不跳过没有通过健康检查或被驱逐的服务，
+// 熔断器打开的服务返回 ErrCircuitOpen。任何一个服务失败时取消其他调用并返回该错误；
+// reply 为第一个成功的结果。需要每个服务的结果或者只调用可用的服务时使用 Gather
+func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.discovery.GetAll()
+	if err != nil || len(servers) == 0 {
+		return err
+	}
+	_, err = xc.gather(ctx, servers, serviceMethod, args, reply, GatherOption{Mode: GatherFailFast})
+	return err
+}
+
+// Broadcast2 与 Broadcast 相同
+func (xc *XClient) Broadcast2(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return xc.Broadcast(ctx, serviceMethod, args, reply)
 }
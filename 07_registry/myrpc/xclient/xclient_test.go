@@ -0,0 +1,874 @@
+package xclient
+
+import (
+	. "MyRpc/07_registry/myrpc"
+	"MyRpc/07_registry/myrpc/registry"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Foo struct {
+	delay  time.Duration // 每次调用的处理时间
+	offset int           // 加在结果上，用于模拟返回不同结果的服务
+	calls  int64
+}
+
+type Args struct{ Num1, Num2 int }
+
+func (f *Foo) Sum(args Args, reply *int) error {
+	atomic.AddInt64(&f.calls, 1)
+	time.Sleep(f.delay)
+	*reply = args.Num1 + args.Num2 + f.offset
+	return nil
+}
+
+func (f *Foo) Fail(args Args, reply *int) error {
+	atomic.AddInt64(&f.calls, 1)
+	return errors.New("foo: always fail")
+}
+
+// closedAddr 返回一个没有服务监听的地址
+func closedAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	addr := "tcp@" + lis.Addr().String()
+	_ = lis.Close()
+	return addr
+}
+
+// startServer 启动一个提供 Foo 服务的服务器，返回其地址
+func startServer(t *testing.T, foo *Foo) string {
+	server := NewServer()
+	_ = server.Register(foo)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	go server.Accept(lis)
+	t.Cleanup(func() { _ = lis.Close() })
+	return "tcp@" + lis.Addr().String()
+}
+
+func TestXClient_P2CAvoidsSlowServer(t *testing.T) {
+	fast, slow := &Foo{delay: time.Millisecond}, &Foo{delay: time.Millisecond * 30}
+	d := NewMultiServerDiscovery([]string{startServer(t, fast), startServer(t, slow)})
+	xc := NewXClient(d, P2CSelect, nil)
+	defer xc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				var reply int
+				_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+			}
+		}()
+	}
+	wg.Wait()
+	t.Logf("fast: %d calls, slow: %d calls", fast.calls, slow.calls)
+	_assert(slow.calls*4 < fast.calls, "expect slow server to receive much less traffic, fast %d slow %d", fast.calls, slow.calls)
+}
+
+func TestXClient_LeastPending(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	xc := NewXClient(d, LeastPendingSelect, nil)
+	defer xc.Close()
+	xc.statsFor("tcp@a").begin()
+	xc.statsFor("tcp@b").begin()
+	xc.statsFor("tcp@b").begin()
+	for i := 0; i < 10; i++ {
+		server, _ := xc.selectServer(context.Background(), "Foo.Sum", nil)
+		_assert(server == "tcp@c", "expect the idle server, got %s", server)
+	}
+	xc.statsFor("tcp@c").begin()
+	xc.statsFor("tcp@c").begin()
+	server, _ := xc.selectServer(context.Background(), "Foo.Sum", nil)
+	_assert(server == "tcp@a", "expect the least loaded server, got %s", server)
+}
+
+func TestXClient_Failover(t *testing.T) {
+	foo := &Foo{}
+	d := NewMultiServerDiscovery([]string{closedAddr(t), startServer(t, foo)})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer xc.Close()
+
+	var reply int
+	failed := 0
+	for i := 0; i < 4; i++ {
+		if xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) != nil {
+			failed++
+		}
+	}
+	_assert(failed == 2, "expect calls to the closed server to fail without retry policy, %d failed", failed)
+	xc.SetRetryPolicy(&RetryPolicy{Mode: Failover, MaxRetries: 1, BaseBackoff: time.Millisecond})
+	for i := 0; i < 10; i++ {
+		err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect failover to the live server, got %v", err)
+	}
+}
+
+func TestXClient_ServerErrorNotRetried(t *testing.T) {
+	foo := &Foo{}
+	d := NewMultiServerDiscovery([]string{startServer(t, foo)})
+	xc := NewXClient(d, RandomSelect, nil)
+	defer xc.Close()
+	xc.SetRetryPolicy(&RetryPolicy{Mode: Failtry, MaxRetries: 3, BaseBackoff: time.Millisecond})
+
+	var reply int
+	err := xc.Call(context.Background(), "Foo.Fail", Args{}, &reply)
+	var serverErr ServerError
+	_assert(errors.As(err, &serverErr), "expect a server error, got %v", err)
+	_assert(foo.calls == 1, "expect server error not to be retried, got %d calls", foo.calls)
+}
+
+func TestXClient_RetryRespectsDeadline(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{closedAddr(t)})
+	xc := NewXClient(d, RandomSelect, nil)
+	defer xc.Close()
+	xc.SetRetryPolicy(&RetryPolicy{Mode: Failtry, MaxRetries: 10, BaseBackoff: time.Millisecond * 100})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*150)
+	defer cancel()
+	start := time.Now()
+	var reply int
+	err := xc.Call(ctx, "Foo.Sum", Args{}, &reply)
+	_assert(err != nil, "expect call to a closed server to fail")
+	_assert(time.Since(start) < time.Millisecond*150, "expect retry to give up before the deadline, took %s", time.Since(start))
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 2)
+	_assert(b.withdraw() && b.withdraw(), "expect the initial budget to allow retries")
+	_assert(!b.withdraw(), "expect the budget to be exhausted")
+	b.deposit()
+	_assert(!b.withdraw(), "expect half a token to be not enough")
+	b.deposit()
+	_assert(b.withdraw(), "expect two calls to earn one retry")
+}
+
+func TestIsRetryable(t *testing.T) {
+	_assert(!IsRetryable(nil), "nil")
+	_assert(!IsRetryable(ServerError("boom")), "server error")
+	_assert(!IsRetryable(fmt.Errorf("rpc client: call failed: %w", context.DeadlineExceeded)), "deadline")
+	_assert(!IsRetryable(ErrShutdown) && !IsRetryable(io.EOF), "request may have been sent")
+	_assert(IsRetryable(&dialError{err: errors.New("connection refused")}), "dial error")
+	_assert(IsRetryable(ErrCircuitOpen), "circuit open")
+
+	p := RetryPolicy{Idempotent: func(serviceMethod string) bool { return serviceMethod == "Foo.Get" }}.withDefaults()
+	_assert(p.retryable("Foo.Get", ErrShutdown) && p.retryable("Foo.Get", io.ErrUnexpectedEOF), "expect idempotent method retried after the request was sent")
+	_assert(!p.retryable("Foo.Set", ErrShutdown), "expect non-idempotent method not retried after the request was sent")
+	_assert(!p.retryable("Foo.Get", ServerError("boom")), "expect server error not retried for idempotent method")
+}
+
+func TestXClient_Hedge(t *testing.T) {
+	fast, slow := &Foo{delay: time.Millisecond}, &Foo{delay: time.Millisecond * 200}
+	d := NewMultiServerDiscovery([]string{startServer(t, slow), startServer(t, fast)})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer xc.Close()
+	xc.SetHedgePolicy(&HedgePolicy{
+		Delay:      time.Millisecond * 20,
+		Idempotent: func(serviceMethod string) bool { return serviceMethod == "Foo.Sum" },
+	})
+
+	for i := 0; i < 6; i++ {
+		start := time.Now()
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect hedged call to succeed, got %v", err)
+		_assert(time.Since(start) < time.Millisecond*150, "expect hedging to avoid the slow server, took %s", time.Since(start))
+	}
+	stats := xc.HedgeStats()
+	_assert(stats.Calls == 6 && stats.Won >= 3 && stats.Hedged >= stats.Won, "unexpected hedge stats %+v", stats)
+
+	// 不是幂等的方法不对冲
+	var reply int
+	_ = xc.Call(context.Background(), "Foo.Fail", Args{}, &reply)
+	_assert(xc.HedgeStats().Calls == 6, "expect non-idempotent calls not to be hedged")
+}
+
+func TestXClient_HedgeWithRetry(t *testing.T) {
+	foo := &Foo{}
+	d := NewMultiServerDiscovery([]string{closedAddr(t), startServer(t, foo)})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer xc.Close()
+	xc.SetHedgePolicy(&HedgePolicy{Delay: time.Second})
+	xc.SetRetryPolicy(&RetryPolicy{Mode: Failover, MaxRetries: 1, BaseBackoff: time.Millisecond})
+
+	// 对冲调用失败后仍然按重试策略换一个服务
+	for i := 0; i < 4; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect hedged call to be retried on the live server, got %v", err)
+	}
+	_assert(xc.HedgeStats().Calls > 4, "expect retries to be hedged calls, got %+v", xc.HedgeStats())
+}
+
+func TestHedger_Percentile(t *testing.T) {
+	h := newHedger(HedgePolicy{Delay: time.Second, Percentile: 0.9})
+	_assert(h.hedgeDelay() == time.Second, "expect Delay before enough samples")
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	delay := h.hedgeDelay()
+	_assert(delay >= time.Millisecond*89 && delay <= time.Millisecond*92, "expect p90 of samples, got %s", delay)
+}
+
+// allowed 判断熔断器是否放行请求，不关心状态版本
+func allowed(b *breaker) bool {
+	_, ok := b.allow()
+	return ok
+}
+
+// recordCall 通过熔断器完成一次调用
+func recordCall(b *breaker, failed bool) {
+	generation, _ := b.allow()
+	b.done(generation, failed)
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(&BreakerPolicy{
+		ConsecutiveFailures: 3,
+		ErrorRate:           0.5,
+		MinRequests:         10,
+		Window:              time.Minute,
+		OpenTimeout:         time.Millisecond * 50,
+		HalfOpenProbes:      1,
+	})
+	for i := 0; i < 3; i++ {
+		generation, ok := b.allow()
+		_assert(ok, "expect closed breaker to allow requests")
+		b.done(generation, true)
+	}
+	_assert(!allowed(b) && !b.available(), "expect breaker to open after consecutive failures")
+
+	time.Sleep(time.Millisecond * 60)
+	_assert(b.available(), "expect half-open breaker to be available")
+	generation, ok := b.allow()
+	_assert(ok, "expect half-open breaker to allow a probe")
+	_assert(!allowed(b), "expect only one probe at a time")
+	b.done(generation, true)
+	_assert(b.stat("").State == BreakerOpen, "expect failed probe to open the breaker again")
+
+	time.Sleep(time.Millisecond * 60)
+	generation, ok = b.allow()
+	_assert(ok, "expect half-open breaker to allow a probe")
+	b.done(generation, false)
+	_assert(b.stat("").State == BreakerClosed, "expect successful probe to close the breaker")
+
+	// 按错误率熔断
+	for i := 0; i < 10; i++ {
+		recordCall(b, i%2 == 0)
+	}
+	_assert(b.stat("").State == BreakerOpen, "expect breaker to open on error rate")
+}
+
+func TestBreaker_StaleResult(t *testing.T) {
+	policy := BreakerPolicy{ConsecutiveFailures: 1, OpenTimeout: time.Millisecond * 20}.withDefaults()
+	b := newBreaker(&policy)
+	stale, _ := b.allow()
+	recordCall(b, true)
+	time.Sleep(time.Millisecond * 30)
+	probe, ok := b.allow()
+	_assert(ok && b.stat("").State == BreakerHalfOpen, "expect half-open breaker to allow a probe")
+
+	// 熔断前放行的请求成功了，不能代替探测请求关闭熔断器
+	b.done(stale, false)
+	_assert(b.stat("").State == BreakerHalfOpen && !allowed(b), "expect stale result to be ignored")
+	b.done(probe, false)
+	_assert(b.stat("").State == BreakerClosed, "expect the probe to close the breaker")
+}
+
+func TestXClient_BreakerExcludesServer(t *testing.T) {
+	foo := &Foo{}
+	dead := closedAddr(t)
+	d := NewMultiServerDiscovery([]string{dead, startServer(t, foo)})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer xc.Close()
+	xc.SetBreakerPolicy(&BreakerPolicy{ConsecutiveFailures: 2, OpenTimeout: time.Minute})
+
+	var reply int
+	failed := 0
+	for i := 0; i < 20; i++ {
+		if xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) != nil {
+			failed++
+		}
+	}
+	_assert(failed == 2, "expect only calls before the breaker opens to fail, %d failed", failed)
+	for _, stat := range xc.BreakerStats() {
+		_assert((stat.Addr == dead) == (stat.State == BreakerOpen), "unexpected breaker state %+v", stat)
+	}
+
+	// 所有服务都熔断时返回 ErrCircuitOpen
+	_ = d.Update([]string{dead})
+	err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrCircuitOpen), "expect ErrCircuitOpen, got %v", err)
+}
+
+func TestXClient_HealthCheck(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Foo{})
+	_ = server.RegisterHealth()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	go server.Accept(lis)
+	defer func() { _ = lis.Close() }()
+	draining, dead := "tcp@"+lis.Addr().String(), closedAddr(t)
+	live := startServer(t, &Foo{})
+
+	d := NewMultiServerDiscovery([]string{draining, dead, live})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer xc.Close()
+	server.SetServing(false)
+	xc.SetHealthCheck(&HealthCheckPolicy{Interval: time.Millisecond * 20, UnhealthyThreshold: 1})
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 10; i++ {
+		selected, err := xc.selectServer(context.Background(), "Foo.Sum", nil)
+		_assert(err == nil && selected == live, "expect only the healthy server, got %s %v", selected, err)
+	}
+	for _, stat := range xc.HealthStats() {
+		_assert(stat.Healthy == (stat.Addr == live), "unexpected health %+v", stat)
+	}
+
+	server.SetServing(true)
+	time.Sleep(time.Millisecond * 100)
+	_assert(xc.healthy(draining), "expect the server to be readmitted after serving again")
+}
+
+func TestXClient_OutlierEjection(t *testing.T) {
+	servers := []string{"tcp@a", "tcp@b", "tcp@c", "tcp@d"}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer xc.Close()
+	p := (&OutlierPolicy{MinRequests: 10, BaseEjectionTime: time.Minute, MaxEjectionPercent: 0.25}).withDefaults()
+	// a 的错误率为 50%，b 的延迟是其他服务的 10 倍
+	for i := 0; i < 20; i++ {
+		for _, server := range servers {
+			latency, failed := time.Millisecond, false
+			switch server {
+			case "tcp@a":
+				failed = i%2 == 0
+			case "tcp@b":
+				latency = time.Millisecond * 10
+			}
+			s := xc.statsFor(server)
+			s.begin()
+			s.end(latency, failed)
+		}
+	}
+	xc.detectOutliers(&p)
+	ejected := 0
+	for _, stat := range xc.HealthStats() {
+		if stat.Ejected {
+			ejected++
+			_assert(stat.Addr == "tcp@a" || stat.Addr == "tcp@b", "unexpected ejection %+v", stat)
+		}
+	}
+	_assert(ejected == 1, "expect MaxEjectionPercent to limit ejections to 1, got %d", ejected)
+
+	available, _ := xc.availableServers()
+	_assert(len(available) == 3, "expect the ejected server to be excluded, got %v", available)
+
+	// 下一轮没有新的调用，不会驱逐更多的服务
+	p.MaxEjectionPercent = 1
+	xc.detectOutliers(&p)
+	available, _ = xc.availableServers()
+	_assert(len(available) == 3, "expect no more ejections without new calls, got %v", available)
+}
+
+func TestXClient_Gather(t *testing.T) {
+	fast, slow := &Foo{delay: time.Millisecond}, &Foo{delay: time.Millisecond * 300}
+	dead := closedAddr(t)
+	servers := []string{startServer(t, fast), startServer(t, slow), dead}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer xc.Close()
+	args := Args{Num1: 1, Num2: 2}
+
+	t.Run("all", func(t *testing.T) {
+		var reply int
+		results, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherOption{Mode: GatherAll})
+		_assert(err != nil && reply == 3, "expect partial failure with a reply, got %v", err)
+		_assert(len(results) == 3, "expect a result per server")
+		for i, r := range results {
+			_assert(r.Addr == servers[i], "expect results in server order")
+			_assert((r.Error != nil) == (r.Addr == dead), "unexpected result %+v", r)
+			if r.Error == nil {
+				_assert(*r.Reply.(*int) == 3, "unexpected reply %+v", r)
+			}
+		}
+	})
+	t.Run("race", func(t *testing.T) {
+		start := time.Now()
+		var reply int
+		results, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherOption{Mode: GatherRace})
+		_assert(err == nil && reply == 3, "expect race to succeed, got %v", err)
+		_assert(time.Since(start) < time.Millisecond*200, "expect race not to wait for the slow server")
+		_assert(errors.Is(results[1].Error, context.Canceled), "expect the slow call to be canceled, got %v", results[1].Error)
+	})
+	t.Run("quorum", func(t *testing.T) {
+		var reply int
+		_, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherOption{Mode: GatherQuorum})
+		_assert(err == nil, "expect 2 of 3 to reach majority, got %v", err)
+		_, err = xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherOption{Mode: GatherQuorum, Quorum: 3})
+		_assert(errors.Is(err, ErrQuorumNotReached), "expect quorum of 3 to fail, got %v", err)
+	})
+	t.Run("broadcast", func(t *testing.T) {
+		start := time.Now()
+		var reply int
+		err := xc.Broadcast(context.Background(), "Foo.Sum", args, &reply)
+		_assert(err != nil, "expect broadcast to fail with a dead server")
+		_assert(time.Since(start) < time.Millisecond*200, "expect broadcast to cancel the slow call")
+	})
+}
+
+func TestXClient_BroadcastUnavailable(t *testing.T) {
+	healthy, ejected, broken := &Foo{}, &Foo{}, &Foo{}
+	servers := []string{startServer(t, healthy), startServer(t, ejected), startServer(t, broken)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer xc.Close()
+	xc.omu.Lock()
+	xc.healthForLocked(ParseInstance(servers[1]).Addr).ejectedUntil = time.Now().Add(time.Minute)
+	xc.omu.Unlock()
+	args := Args{Num1: 1, Num2: 2}
+
+	// Gather 只调用可用的服务，Broadcast 调用所有服务
+	var reply int
+	results, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherOption{Mode: GatherAll})
+	_assert(err == nil && len(results) == 2, "expect gather to skip the ejected server, got %v %v", results, err)
+	_assert(xc.Broadcast(context.Background(), "Foo.Sum", args, &reply) == nil, "expect broadcast to succeed")
+	_assert(atomic.LoadInt64(&ejected.calls) == 1, "expect broadcast to call the ejected server")
+	_assert(atomic.LoadInt64(&healthy.calls) == 2 && atomic.LoadInt64(&broken.calls) == 2, "expect broadcast to call every server")
+
+	// 熔断器打开的服务不会被静默跳过
+	xc.SetBreakerPolicy(&BreakerPolicy{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	recordCall(xc.breakerFor(servers[2]), true)
+	err = xc.Broadcast(context.Background(), "Foo.Sum", args, &reply)
+	_assert(errors.Is(err, ErrCircuitOpen), "expect broadcast to report the open breaker, got %v", err)
+}
+
+func TestXClient_GatherCancelsDial(t *testing.T) {
+	// 接受连接但不响应 HTTP CONNECT，建立连接会一直等到 ConnectTimeout
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	defer func() { _ = lis.Close() }()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	hung := "http@" + lis.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery([]string{hung}), RandomSelect, nil)
+	defer xc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	results, err := xc.Gather(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, nil, GatherOption{Mode: GatherAll})
+	_assert(err != nil && time.Since(start) < time.Second, "expect the pending dial to stop with ctx, took %s", time.Since(start))
+	_assert(errors.Is(results[0].Error, context.DeadlineExceeded), "expect the dial to end with ctx, got %v", results[0].Error)
+	xc.mu.Lock()
+	_assert(len(xc.dials) == 0, "expect a canceled dial not to back off")
+	xc.mu.Unlock()
+}
+
+func TestXClient_EvictRemovedServers(t *testing.T) {
+	a, b := startServer(t, &Foo{}), startServer(t, &Foo{})
+	d := NewMultiServerDiscovery([]string{a, b})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer xc.Close()
+	var reply int
+	for i := 0; i < 2; i++ {
+		_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+	_assert(len(xc.clients) == 2, "expect a client per server, got %d", len(xc.clients))
+
+	_ = d.Update([]string{a})
+	xc.clean()
+	_, ok := xc.clients[b]
+	_assert(len(xc.clients) == 1 && !ok, "expect the client of the removed server to be closed")
+	_assert(len(xc.ServerStats()) == 1, "expect stats of the removed server to be pruned")
+}
+
+func TestXClient_DrainRemovedServers(t *testing.T) {
+	a, b := startServer(t, &Foo{}), startServer(t, &Foo{delay: time.Millisecond * 100})
+	d := NewMultiServerDiscovery([]string{a, b})
+	xc := NewXClient(d, RandomSelect, nil)
+	defer xc.Close()
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- xc.call(b, context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	// 正在进行的调用不受服务下线的影响，结束后连接被关闭
+	_ = d.Update([]string{a})
+	xc.clean()
+	xc.mu.Lock()
+	_, ok := xc.clients[ParseInstance(b).Addr]
+	_assert(!ok && len(xc.draining) == 1, "expect the pool of the removed server to drain")
+	xc.mu.Unlock()
+	_assert(<-done == nil, "expect the in-flight call to finish")
+	xc.clean()
+	xc.mu.Lock()
+	_assert(len(xc.draining) == 0, "expect the drained pool to be closed")
+	xc.mu.Unlock()
+}
+
+func TestXClient_DialWithoutLock(t *testing.T) {
+	// 接受连接但不响应 HTTP CONNECT，建立连接会一直等待
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	defer func() { _ = lis.Close() }()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	hung, fast := "http@"+lis.Addr().String(), startServer(t, &Foo{})
+	xc := NewXClient(NewMultiServerDiscovery([]string{hung, fast}), RandomSelect, nil)
+	defer xc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() { _, _ = xc.dial(ctx, hung) }()
+	time.Sleep(time.Millisecond * 20)
+	start := time.Now()
+	c, err := xc.dial(context.Background(), fast)
+	_assert(err == nil && time.Since(start) < time.Millisecond*500, "expect a hung dial not to block other servers, took %s", time.Since(start))
+	c.release()
+}
+
+func TestXClient_MaxIdle(t *testing.T) {
+	servers := []string{startServer(t, &Foo{}), startServer(t, &Foo{}), startServer(t, &Foo{})}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil)
+	defer xc.Close()
+	xc.SetConnPolicy(&ConnPolicy{MaxIdle: 1})
+	var reply int
+	for i := 0; i < 3; i++ {
+		_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+	_assert(len(xc.clients) == 3, "expect a client per server, got %d", len(xc.clients))
+	xc.clean()
+	_assert(len(xc.clients) == 1, "expect idle clients to be capped, got %d", len(xc.clients))
+}
+
+func TestXClient_CleanLoop(t *testing.T) {
+	xc := NewXClient(NewMultiServerDiscovery([]string{startServer(t, &Foo{})}), RandomSelect, nil)
+	running := func() bool {
+		xc.mu.Lock()
+		defer xc.mu.Unlock()
+		return xc.stopClean != nil
+	}
+	_assert(!running(), "expect no clean loop before the first dial")
+	var reply int
+	_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(running(), "expect the clean loop to start on the first dial")
+	_ = xc.Close()
+	_assert(!running(), "expect Close to stop the clean loop")
+}
+
+func TestXClient_DialBackoff(t *testing.T) {
+	dead := closedAddr(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{dead}), RandomSelect, nil)
+	defer xc.Close()
+	xc.SetConnPolicy(&ConnPolicy{DialBackoff: time.Second})
+
+	_, err := xc.dial(context.Background(), dead)
+	_assert(err != nil && !errors.Is(err, errDialBackoff), "expect the first dial to fail, got %v", err)
+	_, err = xc.dial(context.Background(), dead)
+	_assert(errors.Is(err, errDialBackoff), "expect the second dial to back off, got %v", err)
+	var reply int
+	err = xc.Call(context.Background(), "Foo.Sum", Args{}, &reply)
+	_assert(IsRetryable(err), "expect dial backoff to be retryable, got %v", err)
+}
+
+func TestXClient_ConnPool(t *testing.T) {
+	server := startServer(t, &Foo{delay: time.Millisecond * 50})
+	xc := NewXClient(NewMultiServerDiscovery([]string{server}), RandomSelect, nil)
+	defer xc.Close()
+	xc.SetConnPolicy(&ConnPolicy{PoolSize: 4})
+
+	// 串行的调用只使用一个连接
+	var reply int
+	for i := 0; i < 3; i++ {
+		_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+	stats := xc.PoolStats()
+	_assert(len(stats) == 1 && stats[0].Conns == 1, "expect sequential calls to share a connection, got %+v", stats)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		}()
+	}
+	wg.Wait()
+	stats = xc.PoolStats()
+	_assert(stats[0].Conns == 4 && stats[0].Idle == 4, "expect the pool to grow to PoolSize, got %+v", stats)
+}
+
+func TestXClient_ZoneAware(t *testing.T) {
+	servers := []string{"tcp@a1?zone=a", "tcp@a2?zone=a", "tcp@b1?zone=b", "tcp@b2?zone=b"}
+	xc := NewXClient(NewMultiServerDiscovery(servers), ZoneAwareSelect, nil)
+	defer xc.Close()
+	xc.SetZonePolicy(&ZonePolicy{Zone: "a", MaxPending: 2})
+	selectZone := func() string {
+		server, err := xc.selectServer(context.Background(), "Foo.Sum", nil)
+		_assert(err == nil, "unexpected error %v", err)
+		return ParseInstance(server).Meta["zone"]
+	}
+	for i := 0; i < 20; i++ {
+		_assert(selectZone() == "a", "expect local servers to be preferred")
+	}
+
+	// 本可用区负载过高时溢出到其他可用区
+	for i := 0; i < 2; i++ {
+		xc.statsFor("tcp@a1").begin()
+		xc.statsFor("tcp@a2").begin()
+	}
+	remote := 0
+	for i := 0; i < 20; i++ {
+		if selectZone() == "b" {
+			remote++
+		}
+	}
+	_assert(remote > 0, "expect overloaded zone to spill over")
+
+	// 本可用区可用的服务太少时溢出到其他可用区
+	xc.SetZonePolicy(&ZonePolicy{Zone: "a", MinHealthyPercent: 1})
+	xc.SetBreakerPolicy(&BreakerPolicy{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	recordCall(xc.breakerFor("tcp@a1"), true)
+	for i := 0; i < 20; i++ {
+		selectZone()
+	}
+	stats := xc.ZoneStats()
+	_assert(stats.Remote > 0 && stats.Local+stats.Remote == 20, "unexpected zone stats %+v", stats)
+}
+
+func TestXClient_SessionAffinity(t *testing.T) {
+	servers := []string{"tcp@a", "tcp@b", "tcp@c", "tcp@d"}
+	xc := NewXClient(NewMultiServerDiscovery(servers), SessionAffinitySelect, nil)
+	defer xc.Close()
+	ctx := WithSessionID(context.Background(), "user-1")
+	pinned, err := xc.selectServer(ctx, "Foo.Sum", nil)
+	_assert(err == nil, "unexpected error %v", err)
+	for i := 0; i < 20; i++ {
+		server, _ := xc.selectServer(ctx, "Foo.Sum", nil)
+		_assert(server == pinned, "expect session to stay on %s, got %s", pinned, server)
+	}
+
+	// 绑定的服务熔断后重新绑定，另一个客户端对同一个会话选出同一个服务
+	xc.SetBreakerPolicy(&BreakerPolicy{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	recordCall(xc.breakerFor(pinned), true)
+	repinned, err := xc.selectServer(ctx, "Foo.Sum", nil)
+	_assert(err == nil && repinned != pinned, "expect session to be re-pinned, got %s", repinned)
+	other := NewXClient(NewMultiServerDiscovery(servers), SessionAffinitySelect, nil)
+	defer other.Close()
+	other.SetBreakerPolicy(&BreakerPolicy{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	recordCall(other.breakerFor(pinned), true)
+	server, _ := other.selectServer(ctx, "Foo.Sum", nil)
+	_assert(server == repinned, "expect deterministic re-pinning, got %s and %s", repinned, server)
+
+	// 熔断器恢复后会话仍然留在新的服务上
+	xc.SetBreakerPolicy(nil)
+	server, _ = xc.selectServer(ctx, "Foo.Sum", nil)
+	_assert(server == repinned, "expect session to keep the new server, got %s", server)
+	stats := xc.AffinityStats()
+	_assert(stats.Sessions == 1 && stats.Pins == 1 && stats.Repins == 1 && stats.Hits == 21, "unexpected affinity stats %+v", stats)
+
+	// 空闲的会话过期
+	xc.SetAffinityPolicy(&AffinityPolicy{IdleTimeout: time.Millisecond * 20})
+	_, _ = xc.selectServer(ctx, "Foo.Sum", nil)
+	time.Sleep(time.Millisecond * 30)
+	_, _ = xc.selectServer(WithSessionID(context.Background(), "user-2"), "Foo.Sum", nil)
+	_assert(xc.AffinityStats().Sessions == 1, "expect idle session to expire, got %+v", xc.AffinityStats())
+}
+
+func TestXClient_Rules(t *testing.T) {
+	servers := []string{"tcp@a?version=v1", "tcp@b?version=v1", "tcp@c?version=v2", "tcp@d?version=v1&canary=true"}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil)
+	defer xc.Close()
+	rules := `[
+		{"name": "canary", "match": {"x-canary": "true"}, "route": {"canary": "true"}},
+		{"name": "v2", "service": "Foo.*", "percent": 20, "route": {"version": "v2"}},
+		{"name": "default", "route": {"version": "v1", "canary": ""}}
+	]`
+	parsed, err := ParseRules([]byte(rules))
+	_assert(err == nil && xc.SetRules(parsed) == nil, "failed to set rules: %v", err)
+
+	count := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		server, err := xc.selectServer(context.Background(), "Foo.Sum", nil)
+		_assert(err == nil, "unexpected error %v", err)
+		count[ParseInstance(server).Addr]++
+	}
+	_assert(count["tcp@d"] == 0, "expect canary to receive no default traffic")
+	_assert(count["tcp@c"] > 120 && count["tcp@c"] < 280, "expect about 20%% to v2, got %d", count["tcp@c"])
+	_assert(count["tcp@a"]-count["tcp@b"] < 10 && count["tcp@b"]-count["tcp@a"] < 10, "expect round robin within v1, got %v", count)
+
+	server, _ := xc.selectServer(context.Background(), "Bar.Sum", nil)
+	_assert(server != "tcp@c?version=v2", "expect the v2 rule to only match Foo.*")
+	ctx := WithMetadata(context.Background(), map[string]string{"x-canary": "true"})
+	server, _ = xc.selectServer(ctx, "Foo.Sum", nil)
+	_assert(server == "tcp@d?version=v1&canary=true", "expect canary request to be routed to canary, got %s", server)
+
+	// 路由 key 相同的调用是否被路由的结果不变
+	keyed := WithRoutingKey(context.Background(), "user-1")
+	first, _ := xc.selectServer(keyed, "Foo.Sum", nil)
+	for i := 0; i < 10; i++ {
+		server, _ = xc.selectServer(keyed, "Foo.Sum", nil)
+		_assert((server == "tcp@c?version=v2") == (first == "tcp@c?version=v2"), "expect sampling to be sticky for a routing key")
+	}
+
+	_assert(xc.SetRules([]Rule{{Name: "bad", Service: "["}}) != nil, "expect invalid pattern to be rejected")
+	_ = xc.SetRules([]Rule{{Name: "v3", Route: map[string]string{"version": "v3"}}})
+	_, err = xc.selectServer(context.Background(), "Foo.Sum", nil)
+	_assert(errors.Is(err, ErrNoRouteServers), "expect ErrNoRouteServers, got %v", err)
+}
+
+func TestXClient_LoadRules(t *testing.T) {
+	r := registry.New(time.Minute)
+	_ = r.SetRules([]byte(`[{"name": "v2", "route": {"version": "v2"}}]`))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	server := startServer(t, &Foo{})
+	xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@a?version=v1", server + "?version=v2"}), P2CSelect, nil)
+	defer xc.Close()
+	_assert(xc.LoadRules(RegistryRules(ts.URL+"/myrpc/registry")) == nil, "failed to load rules from registry")
+	_assert(len(xc.Rules()) == 1, "expect one rule, got %+v", xc.Rules())
+
+	// 请求元数据随调用发送
+	ctx := WithMetadata(context.Background(), map[string]string{"x-user": "1"})
+	for i := 0; i < 5; i++ {
+		var reply int
+		err := xc.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect calls to be routed to the v2 server, got %v", err)
+	}
+
+	f, _ := ioutil.TempFile("", "myrpc-rules")
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`[{"name": "v1", "route": {"version": "v1"}}, {"name": "v2", "route": {"version": "v2"}}]`)
+	_ = f.Close()
+	_assert(xc.LoadRules(FileRules(f.Name())) == nil, "failed to load rules from file")
+	_assert(len(xc.Rules()) == 2, "expect two rules, got %+v", xc.Rules())
+}
+
+func TestXClient_Mirror(t *testing.T) {
+	prod := startServer(t, &Foo{})
+	same, different := &Foo{}, &Foo{offset: 1}
+	shadows := NewMultiServerDiscovery([]string{startServer(t, same) + "?shadow=same", startServer(t, different) + "?shadow=different"})
+	xc := NewXClient(NewMultiServerDiscovery([]string{prod}), RandomSelect, nil)
+	defer xc.Close()
+
+	waitMirrored := func(n uint64) MirrorReport {
+		for i := 0; i < 100; i++ {
+			report := xc.MirrorReport()
+			if report.Equal+report.Different+report.Errors >= n {
+				return report
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return xc.MirrorReport()
+	}
+	var reply int
+	xc.SetMirrorPolicy(&MirrorPolicy{Discovery: shadows, Shadow: map[string]string{"shadow": "same"}})
+	for i := 0; i < 5; i++ {
+		_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+	report := waitMirrored(5)
+	_assert(report.Mirrored == 5 && report.Equal == 5, "expect equal replies, got %+v", report)
+	// 调用返回后修改 args 和 reply 不影响影子调用和比较
+	args := &Args{Num1: 1, Num2: 2}
+	for i := 0; i < 5; i++ {
+		_ = xc.Call(context.Background(), "Foo.Sum", args, &reply)
+		args.Num1 += 10
+		reply = -1
+	}
+	report = waitMirrored(10)
+	_assert(report.Equal == 10 && report.Different == 0, "expect args to be copied before Call returns, got %+v", report)
+	// 影子调用不使用 XClient 的连接池和调用统计
+	_assert(len(xc.PoolStats()) == 1 && len(xc.ServerStats()) == 1, "expect shadow calls to bypass the client, got %+v", xc.PoolStats())
+	_assert(xc.SetMirrorPolicy(&MirrorPolicy{}) != nil, "expect a policy mirroring to production servers to be rejected")
+
+	xc.SetMirrorPolicy(&MirrorPolicy{Discovery: shadows, Shadow: map[string]string{"shadow": "different"}, MaxDiffs: 2})
+	for i := 0; i < 5; i++ {
+		_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(reply == 3, "expect the production reply, got %d", reply)
+	}
+	report = waitMirrored(5)
+	_assert(report.Different == 5 && len(report.Diffs) == 2, "expect different replies, got %+v", report)
+	diff := report.Diffs[0]
+	_assert(diff.Production == "3" && diff.Shadow == "4", "unexpected diff %+v", diff)
+
+	// 服务端返回的错误也参与比较
+	xc.SetMirrorPolicy(&MirrorPolicy{Discovery: shadows, Shadow: map[string]string{"shadow": "same"}})
+	_ = xc.Call(context.Background(), "Foo.Fail", Args{}, &reply)
+	report = waitMirrored(1)
+	_assert(report.Equal == 1, "expect server errors to be compared, got %+v", report)
+
+	// 生产调用因为连接失败等原因失败时无法比较
+	_ = shadows.Update(nil)
+	_ = xc.discovery.Update([]string{closedAddr(t)})
+	_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(xc.MirrorReport().Skipped == 1, "expect failed production calls to be skipped")
+}
+
+func TestXClient_WriteMetrics(t *testing.T) {
+	addr := startServer(t, &Foo{})
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	_assert(xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply) == nil, "expect call to succeed")
+	var b strings.Builder
+	xc.WriteMetrics(NewMetricsWriter(&b))
+	for _, line := range []string{
+		fmt.Sprintf(`myrpc_xclient_requests_total{addr="%s"} 1`, addr),
+		fmt.Sprintf(`myrpc_xclient_open_connections{addr="%s"} 1`, addr),
+		"# TYPE myrpc_xclient_breaker_open gauge",
+	} {
+		_assert(strings.Contains(b.String(), line), "expect %q in metrics:\n%s", line, b.String())
+	}
+	// 设置了名字的 XClient 输出不同的指标，可以添加到同一个指标页面
+	other := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = other.Close() }()
+	_assert(other.SetMetricsName("orders") == nil, "expect a valid metrics name")
+	_assert(other.SetMetricsName("bad-name") != nil, "expect an invalid metrics name to be rejected")
+	_assert(other.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply) == nil, "expect call to succeed")
+	b.Reset()
+	other.WriteMetrics(NewMetricsWriter(&b))
+	line := fmt.Sprintf(`myrpc_xclient_orders_requests_total{addr="%s"} 1`, addr)
+	_assert(strings.Contains(b.String(), line), "expect %q in metrics:\n%s", line, b.String())
+}
@@ -0,0 +1,118 @@
+package xclient
+
+import (
+	"sync/atomic"
+)
+
+// ZonePolicy 是按可用区路由的策略。服务的可用区来自地址中的 zone 元数据，
+// 如 "tcp@10.0.0.1:8000?zone=a"。本可用区的服务不健康或负载过高时，才把请求发到其他可用区
+type ZonePolicy struct {
+	Zone              string  // 调用方所在的可用区
+	MinHealthyPercent float64 // 本可用区可用的服务少于该比例时，在所有可用区中选择
+	MaxPending        float64 // 本可用区的服务平均正在进行的调用数达到该值时，在所有可用区中选择；为 0 时不限制
+}
+
+const defaultMinHealthyPercent = 0.5
+
+// ZoneStats 是按可用区路由的统计
+type ZoneStats struct {
+	Zone       string
+	Local      uint64  // 发到本可用区的调用数
+	Remote     uint64  // 发到其他可用区的调用数
+	LocalShare float64 // 发到本可用区的调用占的比例
+}
+
+// zoneRouter 记录可用区路由的策略和统计
+type zoneRouter struct {
+	policy ZonePolicy
+	local  uint64
+	remote uint64
+}
+
+// SetZonePolicy 设置 ZoneAwareSelect 模式下按可用区路由的策略
+func (xc *XClient) SetZonePolicy(policy *ZonePolicy) {
+	xc.zmu.Lock()
+	defer xc.zmu.Unlock()
+	if policy == nil {
+		xc.zone = nil
+		return
+	}
+	p := *policy
+	if p.MinHealthyPercent <= 0 {
+		p.MinHealthyPercent = defaultMinHealthyPercent
+	}
+	xc.zone = &zoneRouter{policy: p}
+}
+
+// ZoneStats 返回按可用区路由的统计
+func (xc *XClient) ZoneStats() ZoneStats {
+	xc.zmu.Lock()
+	z := xc.zone
+	xc.zmu.Unlock()
+	if z == nil {
+		return ZoneStats{}
+	}
+	stats := ZoneStats{
+		Zone:   z.policy.Zone,
+		Local:  atomic.LoadUint64(&z.local),
+		Remote: atomic.LoadUint64(&z.remote),
+	}
+	if total := stats.Local + stats.Remote; total > 0 {
+		stats.LocalShare = float64(stats.Local) / float64(total)
+	}
+	return stats
+}
+
+// zoneSelect 在本可用区可用的服务中按 P2C 选择；本可用区没有服务、
+// 可用的服务太少或负载过高时，在 available 中选择。没有设置策略时与 P2CSelect 相同
+func (xc *XClient) zoneSelect(available []string) (string, error) {
+	xc.zmu.Lock()
+	z := xc.zone
+	xc.zmu.Unlock()
+	if z == nil {
+		return xc.p2cSelect(available)
+	}
+	candidates := z.localCandidates(xc, available)
+	if candidates == nil {
+		candidates = available
+	}
+	server, err := xc.p2cSelect(candidates)
+	if err != nil {
+		return "", err
+	}
+	if ParseInstance(server).Meta["zone"] == z.policy.Zone {
+		atomic.AddUint64(&z.local, 1)
+	} else {
+		atomic.AddUint64(&z.remote, 1)
+	}
+	return server, nil
+}
+
+// localCandidates 返回本可用区中可以承接请求的服务，需要溢出到其他可用区时返回 nil
+func (z *zoneRouter) localCandidates(xc *XClient, available []string) []string {
+	all, err := xc.discovery.GetAll()
+	if err != nil {
+		return nil
+	}
+	total := 0
+	for _, server := range all {
+		if ParseInstance(server).Meta["zone"] == z.policy.Zone {
+			total++
+		}
+	}
+	var local []string
+	var pending int64
+	for _, server := range available {
+		if ParseInstance(server).Meta["zone"] == z.policy.Zone {
+			local = append(local, server)
+			pending += xc.statsFor(server).pending()
+		}
+	}
+	if len(local) == 0 || float64(len(local)) < float64(total)*z.policy.MinHealthyPercent {
+		return nil
+	}
+	if z.policy.MaxPending > 0 && float64(pending)/float64(len(local)) >= z.policy.MaxPending {
+		return nil
+	}
+	return local
+}